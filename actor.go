@@ -0,0 +1,42 @@
+package aeds
+
+import (
+	"golang.org/x/net/context"
+)
+
+// CanSetModifiedBy is implemented by any Entity which records who last
+// changed it.  Put, PutMulti, PutGetOld, PutTx and Modify call SetModifiedBy
+// with the actor from the context (see WithActor) just before HookBeforePut.
+// If the context has no actor, the entity is left alone.
+type CanSetModifiedBy interface {
+	SetModifiedBy(actor string)
+}
+
+type actorKey struct{}
+
+// WithActor returns a copy of c which identifies actor (a user ID, for
+// example) as the one making changes.  Entities written with the returned
+// context are stamped via CanSetModifiedBy.  Callbacks such as OnMutate can
+// retrieve the actor with Actor.
+func WithActor(c context.Context, actor string) context.Context {
+	return context.WithValue(c, actorKey{}, actor)
+}
+
+// Actor returns the actor recorded in c by WithActor, or an empty string if
+// there isn't one.
+func Actor(c context.Context) string {
+	actor, _ := c.Value(actorKey{}).(string)
+	return actor
+}
+
+// stampActor records c's actor on e, if both are available
+func stampActor(c context.Context, e Entity) {
+	x, ok := e.(CanSetModifiedBy)
+	if !ok {
+		return
+	}
+	actor := Actor(c)
+	if actor != "" {
+		x.SetModifiedBy(actor)
+	}
+}
@@ -1,11 +1,11 @@
 package aeds
 
 import (
-	"bytes"
-	"encoding/gob"
+	"fmt"
 	"time"
 
 	"golang.org/x/net/context"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/memcache"
@@ -24,6 +24,19 @@ type HasGetHook interface {
 	HookAfterGet()
 }
 
+// HasChangeHook is implemented by any Entity that needs to compare its new
+// state with its previous state before being written.  This is often used to
+// maintain aggregates which depend on which fields changed.
+//
+// Put, PutGetOld and PutTx read the previous entity in a transaction and pass
+// it to HookBeforePutWithOld (nil if the entity is new) just before
+// HookBeforePut.  Modify passes the entity as it was before its changes.
+// That costs an extra read, so only entities which implement this interface
+// pay for it.  PutMulti doesn't call it, so use Put for such entities.
+type HasChangeHook interface {
+	HookBeforePutWithOld(old Entity)
+}
+
 // HasPutHook is implemented by any Entity that wants to execute
 // specific code before writing the raw entity to datastore.
 // This is often used to calculate derived fields.
@@ -37,7 +50,9 @@ type CanBeCached interface {
 	// CacheTtl indicates how long the entity should be cached in memcache.
 	// Return zero to disable memcache.  If this method returns a non-zero
 	// duration, the receiver should also implement the GobEncoder and
-	// GobDecoder interfaces.
+	// GobDecoder interfaces.  If the entity has fields of interface type,
+	// their concrete types must be passed to Register.  RegisterEntity
+	// checks all of this during initialization.
 	CacheTtl() time.Duration
 }
 
@@ -51,9 +66,17 @@ type NeedsIdempotentReset interface {
 	IdempotentReset()
 }
 
-// Key returns a datastore key for this entity.
+// CanSetStringId is implemented by any Entity whose ID can be assigned
+// after construction.  It's needed when an entity is identified by something
+// other than its own fields, such as an encoded datastore key.
+type CanSetStringId interface {
+	SetStringId(id string)
+}
+
+// Key returns a datastore key for this entity.  Within PutToKind and
+// FromIdInKind, the key uses their kind instead of e.Kind().
 func Key(c context.Context, e Entity) *datastore.Key {
-	return datastore.NewKey(c, e.Kind(), e.StringId(), 0, nil)
+	return datastore.NewKey(c, entityKind(c, e), e.StringId(), 0, nil)
 }
 
 // Get retrieves an entity directly from the datastore, skipping all
@@ -68,64 +91,242 @@ func Get(c context.Context, e Entity) error {
 	}
 
 	lookupKey := Key(c, e)
-	err := datastore.Get(c, lookupKey, e)
+	release, err := acquireRPC(c)
+	if err != nil {
+		return err
+	}
+	end := startSpan(c, "datastore.Get", e.Kind())
+	err = datastore.Get(c, lookupKey, e)
+	end()
+	release()
 	if err == nil || IsErrFieldMismatch(err) {
-		if x, ok := e.(HasGetHook); ok {
-			x.HookAfterGet()
+		err = afterGet(e)
+		if err != nil {
+			return err
 		}
+		rememberETag(e)
 		return nil
 	}
 	return err
 }
 
-// Put stores an entity in the datastore.
+// Put stores an entity in the datastore.  With MemcacheReturn, Put can
+// return both a key and an error if the entity was stored but its cache
+// entry couldn't be cleared.
 func Put(c context.Context, e Entity) (*datastore.Key, error) {
-	if x, ok := e.(HasPutHook); ok {
-		x.HookBeforePut()
+	if IsReadOnly() {
+		return nil, ErrReadOnly
+	}
+	if _, ok := e.(HasChangeHook); ok {
+		_, key, err := PutGetOld(c, e)
+		return key, err
+	}
+
+	err := putHeavy(c, []Entity{e})
+	if err != nil {
+		return nil, err
+	}
+	release, err := acquireRPC(c)
+	if err != nil {
+		return nil, err
+	}
+	stamp(c, e)
+	err = beforePut(e)
+	if err != nil {
+		release()
+		return nil, err
 	}
 
 	// store entity in the datastore
 	lookupKey := Key(c, e)
+	end := startSpan(c, "datastore.Put", e.Kind())
 	key, err := datastore.Put(c, lookupKey, e)
+	end()
+	release()
+	decryptErr := afterPut(e)
 	if err != nil {
 		return nil, err
 	}
+	if decryptErr != nil {
+		return nil, decryptErr
+	}
+	rememberETag(e)
+
+	// delete from memcache?
+	err = ClearCache(c, e)
+	if err != nil {
+		err = clearCacheFailed(c, "Put", lookupKey, err)
+	}
+	reportMutation(c, key, MutationPut)
+	invalidateDependencies(c, e)
+
+	return key, err
+}
+
+// readOld reads the previous value of e, which has the given key, into a
+// fresh instance.  It's nil if the entity doesn't exist.
+func readOld(c context.Context, key *datastore.Key, e Entity) (Entity, error) {
+	old := newEntity(e)
+	err := limited(c, func() error { return datastore.Get(c, key, old) })
+	switch {
+	case err == nil || IsErrFieldMismatch(err):
+		err = afterGet(old)
+		if err != nil {
+			return nil, err
+		}
+		return old, nil
+	case err == datastore.ErrNoSuchEntity:
+		return nil, nil
+	}
+	return nil, err
+}
+
+// PutGetOld is like Put but also returns the entity's previous value, read in
+// the same transaction as the write.  old is a new instance of e's type, or
+// nil if the entity didn't exist.  Use it to compute diffs or emit change
+// events without racing other writers.
+func PutGetOld(c context.Context, e Entity) (Entity, *datastore.Key, error) {
+	if IsReadOnly() {
+		return nil, nil, ErrReadOnly
+	}
+
+	var old Entity
+	var key *datastore.Key
+	lookupKey := Key(c, e)
+	end := startSpan(c, "datastore.RunInTransaction", e.Kind())
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		var err error
+		old, err = readOld(c, lookupKey, e)
+		if err != nil {
+			return err
+		}
+
+		// write the new value
+		stamp(c, e)
+		if x, ok := e.(HasChangeHook); ok {
+			x.HookBeforePutWithOld(old)
+		}
+		err = putHeavy(c, []Entity{e})
+		if err != nil {
+			return err
+		}
+		err = beforePut(e)
+		if err != nil {
+			return err
+		}
+		err = limited(c, func() error {
+			var err error
+			key, err = datastore.Put(c, lookupKey, e)
+			return err
+		})
+		decryptErr := afterPut(e)
+		if err != nil {
+			return err
+		}
+		return decryptErr
+	}, nil)
+	end()
+	if err != nil {
+		return nil, nil, err
+	}
+	rememberETag(e)
 
 	// delete from memcache?
 	err = ClearCache(c, e)
 	if err != nil {
-		log.Errorf(c, "aeds.Put ClearCache error: %s", err)
+		err = clearCacheFailed(c, "PutGetOld", lookupKey, err)
 	}
+	reportMutation(c, key, MutationPut)
+	invalidateDependencies(c, e)
 
-	return key, nil
+	return old, key, err
 }
 
-// PutMulti stores many entities in the datastore.
+// PutMulti stores many entities in the datastore.  Large slices are split
+// into several datastore calls, so there's no limit on their size.  If some
+// entities couldn't be stored, the error is a *BatchError naming them, and the
+// others are stored as usual.  HookBeforePutWithOld isn't called.  See
+// HasChangeHook
 func PutMulti(c context.Context, es []Entity) ([]*datastore.Key, error) {
+	if IsReadOnly() {
+		return nil, ErrReadOnly
+	}
 	keys := make([]*datastore.Key, 0, len(es))
+	err := putHeavy(c, es)
+	if err != nil {
+		return nil, err
+	}
 
 	// prepare for PutMulti
 	for _, e := range es {
-		if x, ok := e.(HasPutHook); ok {
-			x.HookBeforePut()
+		stamp(c, e)
+		err := beforePut(e)
+		if err != nil {
+			return nil, err
 		}
 		keys = append(keys, Key(c, e))
 	}
 
-	keys, err := datastore.PutMulti(c, keys, es)
-	if err != nil {
+	putKeys := make([]*datastore.Key, len(keys))
+	end := startSpan(c, "datastore.PutMulti", multiKind(es))
+	err = batchCall(len(es), maxPutBatch, func(lo, hi int) error {
+		return limited(c, func() error {
+			k, err := datastore.PutMulti(c, keys[lo:hi], es[lo:hi])
+			copy(putKeys[lo:], k)
+			return err
+		})
+	})
+	end()
+	var decryptErr error
+	for _, e := range es {
+		err := afterPut(e)
+		if err != nil {
+			decryptErr = err
+		}
+	}
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
 		return nil, err
 	}
+	if decryptErr != nil {
+		return nil, decryptErr
+	}
 
-	// delete from memcache?
-	for _, e := range es {
-		err = ClearCache(c, e)
+	var cacheErr error
+	for i, e := range es {
+		if merr != nil && merr[i] != nil {
+			continue // not stored
+		}
+		rememberETag(e)
+
+		// delete from memcache?
+		err := ClearCache(c, e)
 		if err != nil {
-			log.Errorf(c, "aeds.Put ClearCache error: %s", err)
+			err = clearCacheFailed(c, "PutMulti", keys[i], err)
+			if cacheErr == nil {
+				cacheErr = err
+			}
 		}
+		reportMutation(c, keys[i], MutationPut)
+		invalidateDependencies(c, e)
 	}
 
-	return keys, nil
+	if merr != nil {
+		return nil, &BatchError{MultiError: merr, Entities: es, Keys: keys}
+	}
+	return putKeys, cacheErr
+}
+
+// clearCacheFailed handles an error from ClearCache for an entity which has
+// already been written to the datastore.  It returns the error the write
+// should fail with, if any.  See MemcacheErrorPolicy
+func clearCacheFailed(c context.Context, op string, key *datastore.Key, err error) error {
+	log.Errorf(c, "aeds.%s ClearCache error: %s", op, err)
+	reportCacheError(c, key, CacheErrorDelete, err)
+	if MemcacheErrorPolicy == MemcacheReturn {
+		return err
+	}
+	return nil
 }
 
 // ClearCache explicitly clears any memcache entries associated with this
@@ -137,7 +338,9 @@ func ClearCache(c context.Context, e Entity) error {
 		return nil
 	}
 
-	err := memcache.Delete(c, Key(c, e).String())
+	end := startSpan(c, "cache.Delete", e.Kind())
+	err := CacheBackend.Delete(c, entityCacheKey(Key(c, e), e))
+	end()
 	switch err {
 	case nil:
 	case memcache.ErrCacheMiss:
@@ -148,82 +351,391 @@ func ClearCache(c context.Context, e Entity) error {
 	return nil
 }
 
+// writeTombstone replaces an entity's cached value with a tombstone, so that
+// concurrent reads can't put the deleted entity back.  See Note_tombstone
+func writeTombstone(c context.Context, e Entity) error {
+	if !canBeCached(e) {
+		return nil
+	}
+
+	end := startSpan(c, "cache.Set", e.Kind())
+	err := CacheBackend.Set(c, &memcache.Item{
+		Key:        entityCacheKey(Key(c, e), e),
+		Value:      tombstoneValue,
+		Expiration: tombstoneTtl,
+	})
+	end()
+	return err
+}
+
 // Delete removes an entity from the datastore.
 func Delete(c context.Context, e Entity) error {
+	if IsReadOnly() {
+		return ErrReadOnly
+	}
 	lookupKey := Key(c, e)
 
 	// should the entity be removed from memcache too?
-	err := ClearCache(c, e)
+	err := writeTombstone(c, e)
 	if err != nil {
 		return err
 	}
 
-	return datastore.Delete(c, lookupKey)
+	release, err := acquireRPC(c)
+	if err != nil {
+		return err
+	}
+	end := startSpan(c, "datastore.Delete", e.Kind())
+	if _, ok := e.(HasHeavyField); ok {
+		err = datastore.DeleteMulti(c, []*datastore.Key{lookupKey, heavyKey(c, lookupKey)})
+	} else {
+		err = datastore.Delete(c, lookupKey)
+	}
+	end()
+	release()
+	if err != nil {
+		return err
+	}
+	reportMutation(c, lookupKey, MutationDelete)
+	invalidateDependencies(c, e)
+	return nil
 }
 
 // FromId fetches an entity based on its ID.  The given entity
 // should have enough data to calculate the entity's key.  On
 // success, the entity is modified in place with all data from
 // the datastore.
-// Field mismatch errors are ignored.
+// Field mismatch errors are ignored.  See WithCacheBypass for skipping
+// the cache on particular requests.
 func FromId(c context.Context, e Entity) (Entity, error) {
+	e, _, err := fromId(c, e, ReadOptions{})
+	return e, err
+}
+
+// Sources reported by FromIdSource
+const (
+	SourceCache     = "cache"
+	SourceDatastore = "datastore"
+)
+
+// FromIdSource is like FromId but also reports where the entity came from:
+// SourceCache or SourceDatastore.  If there's an error, the source is empty.
+// The entity is modified in place, exactly as with FromId.
+//
+// This is mostly useful for debugging and for logging on particular requests.
+func FromIdSource(c context.Context, e Entity) (string, error) {
+	_, info, err := fromId(c, e, ReadOptions{})
+	if err != nil {
+		return "", err
+	}
+	return info.source, nil
+}
+
+// FromIdWithTtl is like FromId but also reports how much longer the cached
+// copy of the entity will remain in memcache.  If the entity came from the
+// datastore, or was cached by an older version of aeds, the duration is zero.
+// The entity is modified in place, exactly as with FromId.
+//
+// This is helpful for choosing an appropriate CacheTtl.
+func FromIdWithTtl(c context.Context, e Entity) (time.Duration, error) {
+	_, info, err := fromId(c, e, ReadOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return info.remaining, nil
+}
+
+// FromIdAllowStale is like FromId but tolerates datastore failures for
+// entities which implement CanBeStale.  If the cached copy of an entity has
+// outlived CacheTtl and the datastore can't be reached to refresh it,
+// FromIdAllowStale returns the stale copy and true rather than an error.
+//
+// Use it for requests where a slightly old value is better than no value at
+// all.
+func FromIdAllowStale(c context.Context, e Entity) (Entity, bool, error) {
+	e, info, err := fromId(c, e, ReadOptions{AllowStale: true})
+	return e, info.stale, err
+}
+
+// FromIdStrong is like FromId but always reads from the datastore, which is
+// strongly consistent for lookups by key.  It neither reads nor populates
+// memcache, so it's immune to stale cache entries and doesn't leave behind
+// anything that could mislead a later FromId.  Use it right after a write when
+// the latest value must be seen.
+//
+// It behaves exactly like Get but with the same signature as FromId.
+func FromIdStrong(c context.Context, e Entity) (Entity, error) {
+	err := Get(c, e)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ReadOptions selects how FromIdOpts reads an entity.  The zero value reads
+// exactly like FromId.
+type ReadOptions struct {
+	// Timeout, if positive, limits how long the whole read may take.
+	Timeout time.Duration
+
+	// NoCache ignores any cached value and reads from the datastore.  What
+	// it reads replaces the cached value, so it's a way to force a refresh.
+	NoCache bool
+
+	// Strong reads only from the datastore, like FromIdStrong.  The cache is
+	// neither read nor written.
+	Strong bool
+
+	// AllowStale serves a stale cached value if the datastore fails, like
+	// FromIdAllowStale.  It has no effect with NoCache or Strong.
+	AllowStale bool
+}
+
+// ReadResult describes how FromIdOpts found an entity.
+type ReadResult struct {
+	Source    string        // SourceCache or SourceDatastore
+	Stale     bool          // true if a stale cached value was served
+	Remaining time.Duration // how long the cached value had left.  zero if unknown
+}
+
+// FromIdOpts is like FromId but reads according to opts and describes where
+// the entity came from.  It's the general form of FromIdSource, FromIdWithTtl,
+// FromIdAllowStale and FromIdStrong.  If there's an error, the result is
+// empty.  The entity is modified in place, exactly as with FromId.
+func FromIdOpts(c context.Context, e Entity, opts ReadOptions) (ReadResult, error) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		c, cancel = context.WithTimeout(c, opts.Timeout)
+		defer cancel()
+	}
+
+	if opts.Strong {
+		err := Get(c, e)
+		if err != nil {
+			return ReadResult{}, err
+		}
+		return ReadResult{Source: SourceDatastore}, nil
+	}
+
+	_, info, err := fromId(c, e, opts)
+	if err != nil {
+		return ReadResult{}, err
+	}
+	return ReadResult{Source: info.source, Stale: info.stale, Remaining: info.remaining}, nil
+}
+
+// readInfo describes how fromId found an entity
+type readInfo struct {
+	source string // SourceCache or SourceDatastore
+	stale  bool   // true if a stale cache entry was used
+
+	// remaining is how long the cache entry had left, if known
+	remaining time.Duration
+}
+
+func fromId(c context.Context, e Entity, opts ReadOptions) (Entity, readInfo, error) {
 	lookupKey := Key(c, e)
 	var ttl time.Duration
-	if x, ok := e.(CanBeCached); ok {
+	if x, ok := e.(CanBeCached); ok && !BypassesCache(c) {
 		ttl = x.CacheTtl()
 	}
 
 	// should we look in memcache too?
 	cacheMiss := false
+	var stale *cacheValue
+	var prev *memcache.Item // item to replace when filling the cache
 	if ttl > 0 {
-		item, err := memcache.Get(c, lookupKey.String())
+		end := startSpan(c, "cache.Get", e.Kind())
+		item, err := CacheBackend.Get(c, entityCacheKey(lookupKey, e))
+		end()
 		if err == nil {
-			buf := bytes.NewBuffer(item.Value)
-			err := gob.NewDecoder(buf).Decode(e)
-			if x, ok := e.(HasGetHook); ok {
-				x.HookAfterGet()
+			prev = item
+			v, err := parseCacheValue(item.Value)
+			if err == nil && v.tombstone {
+				err = errTombstone // See Note_tombstone
+			}
+			if err == nil && opts.NoCache {
+				err = errCacheSkipped
 			}
-			return e, err
+			if err == nil && !v.fits(e) {
+				err = errBadCacheValue // See Note_typehash
+			}
+			if err == nil && !v.isStale() {
+				err = v.decode(e)
+				if err == nil {
+					err = afterCacheGet(e)
+				}
+				return e, readInfo{source: SourceCache, remaining: v.remaining()}, err
+			}
+			if err == nil && refreshesInBackground(e) && refreshLater(c, e, item) {
+				err = v.decode(e)
+				if err == nil {
+					err = afterCacheGet(e)
+				}
+				return e, readInfo{source: SourceCache, stale: true, remaining: v.remaining()}, err
+			}
+			if err == nil {
+				stale = v // keep it in case datastore fails
+			}
+			cacheMiss = err != errTombstone
 		}
 		if err == memcache.ErrCacheMiss {
 			cacheMiss = true
+		} else if err != nil {
+			reportCacheError(c, lookupKey, CacheErrorGet, err)
 		}
-		// ignore any memcache errors
+		// otherwise ignore memcache errors
 	}
 
-	// look in the datastore
-	err := datastore.Get(c, lookupKey, e)
+	// look in the datastore.  waiting too long counts as a datastore error
+	release, err := acquireRPC(c)
+	if err == nil {
+		end := startSpan(c, "datastore.Get", e.Kind())
+		err = datastore.Get(c, lookupKey, e)
+		end()
+		release()
+	}
 	if err == nil || IsErrFieldMismatch(err) {
-		if x, ok := e.(HasGetHook); ok {
-			x.HookAfterGet()
+		err = afterGet(e)
+		if err != nil {
+			return nil, readInfo{}, err
 		}
+		rememberETag(e)
 
 		// should we update memcache?
 		if cacheMiss && ttl > 0 {
-			if x, ok := e.(HasPutHook); ok {
-				x.HookBeforePut()
-			}
-
-			// encode
-			var value bytes.Buffer
-			err := gob.NewEncoder(&value).Encode(e)
+			err := fillCache(c, lookupKey, e, ttl, prev)
 			if err != nil {
-				return nil, err
+				return nil, readInfo{}, err
 			}
+		}
+
+		return e, readInfo{source: SourceDatastore}, nil
+	}
+
+	// fall back to a stale cache entry?
+	if opts.AllowStale && stale != nil {
+		log.Warningf(c, "aeds.FromId serving stale %s after datastore error: %s", lookupKey, err)
+		err := stale.decode(e)
+		if err == nil {
+			err = afterCacheGet(e)
+		}
+		return e, readInfo{source: SourceCache, stale: true, remaining: stale.remaining()}, err
+	}
+	return nil, readInfo{}, err // unknown datastore error
+}
+
+// fillCache stores an entity, which has just been read from the datastore, in
+// memcache.  prev is the item which was in memcache before the read, or nil
+// if there was none.  Anything written to memcache since then, like a
+// tombstone, is left alone.  Only encoding errors are returned.  Memcache
+// errors are merely reported.
+func fillCache(c context.Context, lookupKey *datastore.Key, e Entity, ttl time.Duration, prev *memcache.Item) error {
+	item, err := filledItem(c, lookupKey, e, ttl)
+	if err != nil || item == nil {
+		return err
+	}
 
-			// store
-			item := &memcache.Item{
-				Key:        lookupKey.String(),
-				Value:      value.Bytes(),
-				Expiration: ttl,
+	end := startSpan(c, "cache.Set", e.Kind())
+	err = storeFilled(c, item, prev)
+	end()
+	switch err {
+	case nil:
+	case memcache.ErrNotStored:
+		reportCacheError(c, lookupKey, CacheErrorTooLarge, err)
+	default:
+		reportCacheError(c, lookupKey, CacheErrorSet, err)
+	}
+	return nil // otherwise ignore memcache errors
+}
+
+// filledItem builds the memcache item with which fillCache stores an entity.
+// The item is nil if the entity shouldn't be cached because of its size,
+// which is reported if it's over memcache's limit.
+func filledItem(c context.Context, lookupKey *datastore.Key, e Entity, ttl time.Duration) (*memcache.Item, error) {
+	err := beforePut(e)
+	if err != nil {
+		return nil, err
+	}
+
+	// encode (See Note_encryption)
+	expiration, freshUntil := cacheTimes(e, ttl)
+	value, err := encodeCacheValue(entityCacheKey(lookupKey, e), e, freshUntil, time.Now().Add(expiration))
+	decryptErr := afterPut(e)
+	if err != nil {
+		return nil, err
+	}
+	if decryptErr != nil {
+		return nil, decryptErr
+	}
+	if MaxCacheSize > 0 && len(value) > MaxCacheSize {
+		return nil, nil // deliberately left uncached
+	}
+
+	item := &memcache.Item{
+		Key:        entityCacheKey(lookupKey, e),
+		Value:      value,
+		Expiration: expiration,
+	}
+	if !fitsInCache(item.Key, item.Value) {
+		reportCacheError(c, lookupKey, CacheErrorTooLarge, ErrCacheTooLarge)
+		return nil, nil
+	}
+	return item, nil
+}
+
+// storeFilled writes an item for fillCache, unless the value in memcache has
+// changed since prev was read.  Losing that race isn't an error.  Backends
+// which can't detect it always overwrite.
+func storeFilled(c context.Context, item, prev *memcache.Item) error {
+	if prev == nil {
+		if x, ok := CacheBackend.(CanAdd); ok {
+			err := x.Add(c, item)
+			if err == memcache.ErrNotStored {
+				return nil // someone filled it first, or it's a tombstone
 			}
-			err = memcache.Set(c, item)
-			_ = err // ignore memcache errors
+			return err
+		}
+	} else if x, ok := CacheBackend.(CanCompareAndSwap); ok {
+		// prev carries memcache's CAS ID
+		prev.Value = item.Value
+		prev.Expiration = item.Expiration
+		err := x.CompareAndSwap(c, prev)
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			return nil // changed or removed since we read it
 		}
+		return err
+	}
+	return CacheBackend.Set(c, item)
+}
+
+// FromEncodedKey fetches an entity based on a key string produced by
+// datastore.Key.Encode.  proto supplies the entity's type and must implement
+// CanSetStringId so that the ID can be copied out of the decoded key.  On
+// success, proto is modified in place, exactly like FromId.
+//
+// The key must be a root key of proto's kind.  Anything else is rejected
+// without touching the datastore, so a crafted key can't be used to fetch an
+// entity of some unexpected type.
+func FromEncodedKey(c context.Context, encoded string, proto Entity) (Entity, error) {
+	key, err := datastore.DecodeKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if key.Kind() != proto.Kind() {
+		return nil, fmt.Errorf("aeds: encoded key has kind %q, expected %q", key.Kind(), proto.Kind())
+	}
 
-		return e, nil
+	x, ok := proto.(CanSetStringId)
+	if !ok {
+		return nil, fmt.Errorf("aeds: kind %q does not implement CanSetStringId", proto.Kind())
+	}
+	x.SetStringId(key.StringID())
+	if !key.Equal(Key(c, proto)) {
+		return nil, fmt.Errorf("aeds: encoded key %s is not a valid %q key", key, proto.Kind())
 	}
-	return nil, err // unknown datastore error
+
+	return FromId(c, proto)
 }
 
 // Modify atomically executes a read, modify, write operation on a single
@@ -242,8 +754,12 @@ func FromId(c context.Context, e Entity) (Entity, error) {
 // doesn't have access to the transactional context used internally.  Other
 // datastore changes will happen, even if the transaction fails to commit.
 func Modify(c context.Context, e Entity, f func(Entity) error) error {
+	if IsReadOnly() {
+		return ErrReadOnly
+	}
 	key := Key(c, e)
 
+	end := startSpan(c, "datastore.RunInTransaction", e.Kind())
 	err := datastore.RunInTransaction(c, func(c context.Context) error {
 		// reset slice fields (inside the transaction so it's retried)
 		if x, ok := e.(NeedsIdempotentReset); ok {
@@ -251,14 +767,22 @@ func Modify(c context.Context, e Entity, f func(Entity) error) error {
 		}
 
 		// fetch most recent entity from datastore
-		err := datastore.Get(c, key, e)
+		err := limited(c, func() error { return datastore.Get(c, key, e) })
 		if err == nil || IsErrFieldMismatch(err) {
-			if x, ok := e.(HasGetHook); ok {
-				x.HookAfterGet()
+			err = afterGet(e)
+			if err != nil {
+				return err
 			}
 		} else {
 			return err
 		}
+		var old Entity
+		if _, ok := e.(HasChangeHook); ok {
+			old, err = readOld(c, key, e)
+			if err != nil {
+				return err
+			}
+		}
 
 		// perform the modifications
 		err = f(e)
@@ -267,25 +791,45 @@ func Modify(c context.Context, e Entity, f func(Entity) error) error {
 		}
 
 		// write entity to datastore
-		if x, ok := e.(HasPutHook); ok {
-			x.HookBeforePut()
+		stamp(c, e)
+		if x, ok := e.(HasChangeHook); ok {
+			x.HookBeforePutWithOld(old)
 		}
-		_, err = datastore.Put(c, key, e)
-		return err
+		err = putHeavy(c, []Entity{e})
+		if err != nil {
+			return err
+		}
+		err = beforePut(e)
+		if err != nil {
+			return err
+		}
+		err = limited(c, func() error {
+			_, err := datastore.Put(c, key, e)
+			return err
+		})
+		decryptErr := afterPut(e)
+		if err != nil {
+			return err
+		}
+		return decryptErr
 	}, nil)
+	end()
 
 	// did the transaction succeed?
 	if err != nil {
 		return err
 	}
+	rememberETag(e)
 
 	// delete cache entry (See Note_1)
 	err = ClearCache(c, e)
 	if err != nil {
-		return err
+		err = clearCacheFailed(c, "Modify", key, err)
 	}
+	reportMutation(c, key, MutationPut)
+	invalidateDependencies(c, e)
 
-	return nil
+	return err
 }
 
 // Note_1
@@ -0,0 +1,120 @@
+package aeds
+
+import (
+	"strconv"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// Cache is the interface aeds uses to cache entities.  The methods mirror
+// those in the memcache package.  An implementation must report a missing
+// item with memcache.ErrCacheMiss.  Items should expire according to their
+// Expiration field, where zero means "never."
+//
+// Only Key, Value and Expiration are meaningful in items handled by aeds.
+type Cache interface {
+	Get(c context.Context, key string) (*memcache.Item, error)
+	GetMulti(c context.Context, keys []string) (map[string]*memcache.Item, error)
+	Set(c context.Context, item *memcache.Item) error
+	SetMulti(c context.Context, items []*memcache.Item) error
+	Delete(c context.Context, key string) error
+	DeleteMulti(c context.Context, keys []string) error
+}
+
+// CanCompareAndSwap is implemented by any Cache which can replace an item only
+// if it hasn't changed since it was fetched by Get.  A conflicting change
+// should be reported with memcache.ErrCASConflict or memcache.ErrNotStored.
+// aeds uses it, when available, to avoid resurrecting an item which was
+// deleted in the meantime.
+type CanCompareAndSwap interface {
+	CompareAndSwap(c context.Context, item *memcache.Item) error
+}
+
+// CanAdd is implemented by any Cache which can store an item only if its key
+// isn't already present.  An existing item should be reported with
+// memcache.ErrNotStored.  aeds uses it, when available, so that filling the
+// cache after a miss can't overwrite a deleted entity's tombstone.
+type CanAdd interface {
+	Add(c context.Context, item *memcache.Item) error
+}
+
+// CanAddMulti is like CanAdd for several items at once.  Items which already
+// exist should be reported with memcache.ErrNotStored in an
+// appengine.MultiError.  WarmCache uses it, when available, to fill the cache
+// in one round trip.
+type CanAddMulti interface {
+	AddMulti(c context.Context, items []*memcache.Item) error
+}
+
+// CacheBackend is the cache used for all entities.  It defaults to App
+// Engine's memcache.  Replace it during initialization to cache entities
+// somewhere else, such as Redis.
+var CacheBackend Cache = Memcache{}
+
+// Memcache is a Cache backed by App Engine's memcache.
+type Memcache struct{}
+
+func (Memcache) Get(c context.Context, key string) (*memcache.Item, error) {
+	return memcache.Get(c, key)
+}
+
+func (Memcache) GetMulti(c context.Context, keys []string) (map[string]*memcache.Item, error) {
+	return memcache.GetMulti(c, keys)
+}
+
+func (Memcache) Add(c context.Context, item *memcache.Item) error {
+	return memcache.Add(c, item)
+}
+
+func (Memcache) AddMulti(c context.Context, items []*memcache.Item) error {
+	return memcache.AddMulti(c, items)
+}
+
+func (Memcache) Set(c context.Context, item *memcache.Item) error {
+	return memcache.Set(c, item)
+}
+
+func (Memcache) SetMulti(c context.Context, items []*memcache.Item) error {
+	return memcache.SetMulti(c, items)
+}
+
+func (Memcache) CompareAndSwap(c context.Context, item *memcache.Item) error {
+	return memcache.CompareAndSwap(c, item)
+}
+
+func (Memcache) Delete(c context.Context, key string) error {
+	return memcache.Delete(c, key)
+}
+
+func (Memcache) DeleteMulti(c context.Context, keys []string) error {
+	return memcache.DeleteMulti(c, keys)
+}
+
+// KeyPrefix is prepended to every cache key aeds uses.  It defaults to empty,
+// which leaves keys as they've always been.  Services which share a memcache
+// (different modules in the same project, for example) should each set a
+// distinct prefix during initialization so that they can't read each other's
+// cached entities.  Changing it effectively empties the cache.
+var KeyPrefix string
+
+// cacheKey returns the cache key for an entity with the given datastore key.
+// Keys in the default namespace are unchanged from earlier versions.  Others
+// include the namespace.  App Engine's memcache already keeps namespaces apart
+// but other backends might not, and datastore.Key.String omits it.
+func cacheKey(key *datastore.Key) string {
+	if ns := key.Namespace(); ns != "" {
+		return KeyPrefix + ns + ":" + key.String()
+	}
+	return KeyPrefix + key.String()
+}
+
+// entityCacheKey returns the cache key for entity e, whose datastore key is
+// key.  It's cacheKey plus e's schema version, if any.  See HasSchemaVersion
+func entityCacheKey(key *datastore.Key, e Entity) string {
+	if x, ok := e.(HasSchemaVersion); ok && x.SchemaVersion() != 0 {
+		return cacheKey(key) + "#v" + strconv.Itoa(x.SchemaVersion())
+	}
+	return cacheKey(key)
+}
@@ -0,0 +1,85 @@
+package aeds
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// BatchError describes a partially failed batch operation by naming each
+// entity which failed.  PutMulti and GetMulti return one when only some
+// entities failed.  Callers which compare elements with errors like
+// datastore.ErrNoSuchEntity can find them in MultiError.
+type BatchError struct {
+	// MultiError is the original error, with one element per entity.
+	MultiError appengine.MultiError
+
+	// Entities and Keys hold each entity in the batch and its key, in the
+	// same order as MultiError.
+	Entities []Entity
+	Keys     []*datastore.Key
+}
+
+// maxNamedFailures is how many failures BatchError.Error describes
+const maxNamedFailures = 10
+
+func (e *BatchError) Error() string {
+	var parts []string
+	failed := 0
+	for i, err := range e.MultiError {
+		if err == nil {
+			continue
+		}
+		failed++
+		if failed <= maxNamedFailures {
+			parts = append(parts, fmt.Sprintf("%s: %s", e.Keys[i], err))
+		}
+	}
+	if failed > maxNamedFailures {
+		parts = append(parts, fmt.Sprintf("and %d more", failed-maxNamedFailures))
+	}
+	return fmt.Sprintf("aeds: %d of %d entities failed: %s", failed, len(e.MultiError), strings.Join(parts, "; "))
+}
+
+// Failures returns the error for each entity which failed, by its index in
+// Entities.  Entities which succeeded are omitted.
+func (e *BatchError) Failures() map[int]error {
+	failures := make(map[int]error)
+	for i, err := range e.MultiError {
+		if err != nil {
+			failures[i] = err
+		}
+	}
+	return failures
+}
+
+// NameFailures converts an appengine.MultiError from a batch operation on es,
+// such as datastore.PutMulti, into a *BatchError which names the entities
+// that failed.  Other errors, including nil, are returned unchanged.
+func NameFailures(c context.Context, es []Entity, err error) error {
+	merr, ok := err.(appengine.MultiError)
+	if !ok || len(merr) != len(es) {
+		return err
+	}
+
+	keys := make([]*datastore.Key, len(es))
+	for i, e := range es {
+		keys[i] = Key(c, e)
+	}
+	return &BatchError{MultiError: merr, Entities: es, Keys: keys}
+}
+
+// multiError returns the appengine.MultiError in err, which may be a
+// *BatchError, or nil if there isn't one
+func multiError(err error) appengine.MultiError {
+	switch err := err.(type) {
+	case appengine.MultiError:
+		return err
+	case *BatchError:
+		return err.MultiError
+	}
+	return nil
+}
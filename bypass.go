@@ -0,0 +1,22 @@
+package aeds
+
+import (
+	"golang.org/x/net/context"
+)
+
+type bypassKey struct{}
+
+// WithCacheBypass returns a copy of c which makes FromId (and kvs.Find) read
+// straight from the datastore.  Cached values are neither read nor refreshed,
+// so a single request can show whether a problem comes from the cache.
+// Writes still clear or update the cache as usual, since skipping that would
+// leave stale values behind for everyone else.
+func WithCacheBypass(c context.Context) context.Context {
+	return context.WithValue(c, bypassKey{}, true)
+}
+
+// BypassesCache returns true if c was made by WithCacheBypass
+func BypassesCache(c context.Context) bool {
+	bypass, _ := c.Value(bypassKey{}).(bool)
+	return bypass
+}
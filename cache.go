@@ -0,0 +1,506 @@
+package aeds
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/fnv"
+	"io"
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// CanCompressCache is implemented by any cacheable Entity that wants its
+// memcache value compressed with gzip.  This trades a little CPU for smaller
+// memcache items, which helps large entities fit under memcache's item size
+// limit.
+type CanCompressCache interface {
+	// CacheCompress returns true if the entity's cached value should be
+	// compressed.
+	CacheCompress() bool
+}
+
+// CanBeStale is implemented by any cacheable Entity that's willing to be
+// served from a stale cache entry when the datastore is unavailable.  See
+// FromIdAllowStale.
+type CanBeStale interface {
+	// StaleTtl indicates how long a cached entity is kept in memcache after
+	// CacheTtl has elapsed.  During that time, FromId ignores the cached
+	// value (unless the entity implements CanRefreshInBackground) but
+	// FromIdAllowStale can fall back to it.
+	StaleTtl() time.Duration
+}
+
+// CanSkipCachedGetHook is implemented by any cacheable Entity whose
+// HookAfterGet results are already present in its cached value.  Cached values
+// are encoded after HookAfterGet has run, so any exported fields it calculates
+// are part of the cached copy.  Entities with expensive hooks can avoid
+// recalculating those fields on every cache hit.
+type CanSkipCachedGetHook interface {
+	// SkipCachedGetHook returns true if HookAfterGet should only run after
+	// reading from the datastore, not after reading from memcache.
+	SkipCachedGetHook() bool
+}
+
+// HasSchemaVersion is implemented by any cacheable Entity whose Go layout
+// changes over time.  The version is part of the entity's cache key, so
+// bumping it when the struct changes makes every instance ignore values
+// cached in the old layout.  Instances still running the old code keep using
+// the old key until they're replaced.
+type HasSchemaVersion interface {
+	// SchemaVersion returns the current version of the entity's layout.
+	// Zero leaves the cache key unchanged.
+	SchemaVersion() int
+}
+
+// OnCacheError, if not nil, is called whenever aeds encounters a memcache
+// error which doesn't otherwise affect the result of an operation.  Cache
+// problems normally go unnoticed since the datastore is always authoritative.
+// This hook makes them visible, for example to alert when an entity is too
+// large to ever be cached.
+//
+// reason is one of the CacheError constants.
+var OnCacheError func(c context.Context, key *datastore.Key, reason string, err error)
+
+// Reasons reported to OnCacheError
+const (
+	CacheErrorGet      = "get"       // reading from memcache failed
+	CacheErrorSet      = "set"       // writing to memcache failed
+	CacheErrorDelete   = "delete"    // removing from memcache failed
+	CacheErrorTooLarge = "too large" // value exceeds memcache's size limit
+)
+
+// MemcachePolicy describes how aeds reacts to a memcache error which
+// accompanies a successful datastore operation.  See MemcacheErrorPolicy
+type MemcachePolicy int
+
+const (
+	// MemcacheIgnore carries on as if nothing happened.  Failing to clear
+	// the cache after a write is still logged, since it leaves the cache
+	// stale.
+	MemcacheIgnore MemcachePolicy = iota
+
+	// MemcacheLog also logs every other memcache error, like failing to
+	// populate the cache after a datastore read.
+	MemcacheLog
+
+	// MemcacheReturn logs like MemcacheLog.  In addition, Put, PutGetOld,
+	// PutMulti and RunInTransaction fail with the memcache error if they
+	// can't clear the cache after a successful write.  The write itself is
+	// not undone.
+	MemcacheReturn
+)
+
+// MemcacheErrorPolicy decides what happens when memcache fails but the
+// datastore doesn't.  It defaults to MemcacheIgnore, since the datastore is
+// authoritative.  OnCacheError is called regardless of the policy.
+var MemcacheErrorPolicy = MemcacheIgnore
+
+// ErrCacheTooLarge is reported to OnCacheError when an entity's encoded value
+// is too large for memcache.
+var ErrCacheTooLarge = errors.New("aeds: entity is too large for memcache")
+
+// MaxCacheSize, if positive, is the size of the largest encoded value aeds
+// stores in the cache.  Entities with larger values (See EncodedSize) are
+// read from the datastore every time, without being reported to
+// OnCacheError on each read.  Values over memcache's own limit are never
+// cached, whether or not MaxCacheSize is set, and those are reported.
+var MaxCacheSize int
+
+// CompressOversized, if true, compresses the cached value of any entity which
+// would otherwise be too large to cache (See MaxCacheSize), even if the
+// entity doesn't implement CanCompressCache.  Entities just over the limit
+// can then be cached after all.  Values which fit are left uncompressed, so
+// ordinary reads don't pay for decompression.
+var CompressOversized bool
+
+// memcache's limit on the combined size of an item's key and value.  The
+// overhead is approximate.
+const (
+	maxCacheItemSize  = 1 << 20
+	cacheItemOverhead = 73
+)
+
+// cached values start with a version byte, cacheVersionBase plus
+// cacheVersion, followed by a byte of flags.  See Note_codec
+const (
+	cacheVersionBase byte = 0xC0
+	cacheVersion     byte = 1
+	cacheHeaderSize       = 2
+)
+
+// flag bits in the header of values stored in memcache.  See Note_codec
+const (
+	cacheGzip       byte = 0x01 // body is compressed
+	cacheFreshUntil byte = 0x02 // header includes a freshness deadline
+	cacheTypeHash   byte = 0x04 // header includes a type fingerprint
+	cacheExpiresAt  byte = 0x08 // header includes an expiration time
+	cacheTombstone  byte = 0x10 // entity was recently deleted.  no body
+)
+
+var errBadCacheValue = errors.New("aeds: malformed cache value")
+
+// errTombstone means a cache value is a tombstone rather than an entity
+var errTombstone = errors.New("aeds: entity was recently deleted")
+
+// errCacheSkipped means a cache value was ignored because of ReadOptions
+var errCacheSkipped = errors.New("aeds: cached value skipped")
+
+// tombstoneValue is the cache value left behind by Delete.  See
+// Note_tombstone
+var tombstoneValue = []byte{cacheVersionBase + cacheVersion, cacheTombstone}
+
+// tombstoneTtl is how long a tombstone stays in memcache.  It should outlast
+// any read which started before the delete.
+const tombstoneTtl = 30 * time.Second
+
+// cacheValue is a parsed memcache value
+type cacheValue struct {
+	gzip       bool
+	tombstone  bool      // the entity was recently deleted
+	freshUntil time.Time // zero if the value never becomes stale
+	expiresAt  time.Time // zero if unknown
+	typeHash   uint32    // zero if the value has no type fingerprint
+	body       []byte
+}
+
+// EncodedSize returns the number of bytes e would occupy in memcache, using
+// the same encoding as FromId (including compression, if enabled).
+// HookBeforePut is executed first, so derived fields are included.  Nothing is
+// stored anywhere.
+//
+// This is helpful for rejecting oversized entities with a clear message before
+// trying to write them.
+func EncodedSize(e Entity) (int, error) {
+	err := beforePut(e)
+	if err != nil {
+		return 0, err
+	}
+
+	var freshUntil, expiresAt time.Time
+	if x, ok := e.(CanBeCached); ok && x.CacheTtl() > 0 {
+		var expiration time.Duration
+		expiration, freshUntil = cacheTimes(e, x.CacheTtl())
+		expiresAt = time.Now().Add(expiration)
+	}
+
+	compress := compressesCache(e)
+	var w countingWriter
+	err = writeCacheValue(&w, e, freshUntil, expiresAt, compress)
+	if err == nil && CompressOversized && !compress && tooLargeToCache("", int(w)) {
+		w = 0
+		err = writeCacheValue(&w, e, freshUntil, expiresAt, true)
+	}
+	decryptErr := afterPut(e)
+	if err != nil {
+		return 0, err
+	}
+	return int(w), decryptErr
+}
+
+// encodeCacheValue builds the memcache value for an entity stored under the
+// given cache key.  If freshUntil is non-zero, the value is considered stale
+// after that time.  If expiresAt is non-zero, it records when memcache will
+// discard the value.
+func encodeCacheValue(key string, e Entity, freshUntil, expiresAt time.Time) ([]byte, error) {
+	compress := compressesCache(e)
+	var buf bytes.Buffer
+	err := writeCacheValue(&buf, e, freshUntil, expiresAt, compress)
+	if err == nil && CompressOversized && !compress && tooLargeToCache(key, buf.Len()) {
+		buf.Reset()
+		err = writeCacheValue(&buf, e, freshUntil, expiresAt, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compressesCache returns true if e asks for its cached value to be
+// compressed
+func compressesCache(e Entity) bool {
+	x, ok := e.(CanCompressCache)
+	return ok && x.CacheCompress()
+}
+
+// writeCacheValue writes the memcache value for an entity to w, compressing
+// the body if asked
+func writeCacheValue(w io.Writer, e Entity, freshUntil, expiresAt time.Time, compress bool) error {
+	v := &cacheValue{
+		gzip:       compress,
+		freshUntil: freshUntil,
+		expiresAt:  expiresAt,
+		typeHash:   typeHash(e),
+	}
+	_, err := w.Write(v.header())
+	if err != nil {
+		return err
+	}
+
+	if v.gzip {
+		gz := gzip.NewWriter(w)
+		err = gob.NewEncoder(gz).Encode(e)
+		if err != nil {
+			return gobError(e, err)
+		}
+		return gz.Close()
+	}
+
+	err = gob.NewEncoder(w).Encode(e)
+	return gobError(e, err)
+}
+
+// countingWriter discards its input but counts how many bytes it has seen
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// header encodes the header fields of a cache value.  It's the only place
+// headers are written.  See Note_codec
+func (v *cacheValue) header() []byte {
+	var flags byte
+	if v.gzip {
+		flags |= cacheGzip
+	}
+	if v.tombstone {
+		flags |= cacheTombstone
+	}
+	if !v.freshUntil.IsZero() {
+		flags |= cacheFreshUntil
+	}
+	if v.typeHash != 0 {
+		flags |= cacheTypeHash
+	}
+	if !v.expiresAt.IsZero() {
+		flags |= cacheExpiresAt
+	}
+
+	b := make([]byte, cacheHeaderSize, cacheHeaderSize+8+8+4)
+	b[0] = cacheVersionBase + cacheVersion
+	b[1] = flags
+	for _, t := range []time.Time{v.freshUntil, v.expiresAt} {
+		if !t.IsZero() {
+			b = append(b, make([]byte, 8)...)
+			binary.BigEndian.PutUint64(b[len(b)-8:], uint64(t.UnixNano()))
+		}
+	}
+	if v.typeHash != 0 {
+		b = append(b, make([]byte, 4)...)
+		binary.BigEndian.PutUint32(b[len(b)-4:], v.typeHash)
+	}
+	return b
+}
+
+// parseCacheValue parses a value produced by encodeCacheValue.  It's the only
+// place headers are read.  Values written in another format version,
+// including those from before versions existed, are errBadCacheValue so
+// that callers treat them as a cache miss.  See Note_codec
+func parseCacheValue(value []byte) (*cacheValue, error) {
+	if len(value) < cacheHeaderSize || value[0] != cacheVersionBase+cacheVersion {
+		return nil, errBadCacheValue
+	}
+
+	header := value[1]
+	v := &cacheValue{body: value[cacheHeaderSize:]}
+	if header&^(cacheGzip|cacheFreshUntil|cacheTypeHash|cacheExpiresAt|cacheTombstone) != 0 {
+		return nil, errBadCacheValue
+	}
+	v.gzip = header&cacheGzip != 0
+	v.tombstone = header&cacheTombstone != 0
+	if header&cacheFreshUntil != 0 {
+		if len(v.body) < 8 {
+			return nil, errBadCacheValue
+		}
+		nanos := int64(binary.BigEndian.Uint64(v.body))
+		v.freshUntil = time.Unix(0, nanos)
+		v.body = v.body[8:]
+	}
+	if header&cacheExpiresAt != 0 {
+		if len(v.body) < 8 {
+			return nil, errBadCacheValue
+		}
+		nanos := int64(binary.BigEndian.Uint64(v.body))
+		v.expiresAt = time.Unix(0, nanos)
+		v.body = v.body[8:]
+	}
+	if header&cacheTypeHash != 0 {
+		if len(v.body) < 4 {
+			return nil, errBadCacheValue
+		}
+		v.typeHash = binary.BigEndian.Uint32(v.body)
+		v.body = v.body[4:]
+	}
+	return v, nil
+}
+
+// setFreshUntil replaces the freshness deadline of an encoded value which
+// already has one.  The deadline immediately follows the flags byte.  See
+// Note_codec
+func setFreshUntil(value []byte, t time.Time) {
+	i := cacheHeaderSize
+	binary.BigEndian.PutUint64(value[i:i+8], uint64(t.UnixNano()))
+}
+
+// setExpiresAt replaces the expiration time of an encoded value, if it has
+// one.  It follows the freshness deadline.  See Note_codec
+func setExpiresAt(value []byte, t time.Time) {
+	flags := value[1]
+	if flags&cacheExpiresAt == 0 {
+		return
+	}
+	i := cacheHeaderSize
+	if flags&cacheFreshUntil != 0 {
+		i += 8
+	}
+	binary.BigEndian.PutUint64(value[i:i+8], uint64(t.UnixNano()))
+}
+
+// remaining returns how long memcache will keep this value, or zero if
+// that's unknown
+func (v *cacheValue) remaining() time.Duration {
+	if v.expiresAt.IsZero() {
+		return 0
+	}
+	d := v.expiresAt.Sub(time.Now())
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// fits returns true if this value may be decoded into e.  Values without a
+// type fingerprint, like tombstones, are assumed to fit.
+func (v *cacheValue) fits(e Entity) bool {
+	return v.typeHash == 0 || v.typeHash == typeHash(e)
+}
+
+// typeHash returns a fingerprint of an entity's Go type.  See Note_typehash
+func typeHash(e Entity) uint32 {
+	t := reflect.TypeOf(e)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(t.PkgPath() + "." + t.Name()))
+	return h.Sum32()
+}
+
+// isStale returns true if this value's freshness deadline has passed
+func (v *cacheValue) isStale() bool {
+	return !v.freshUntil.IsZero() && time.Now().After(v.freshUntil)
+}
+
+// decode populates an entity from this value's body
+func (v *cacheValue) decode(e Entity) error {
+	var r io.Reader = bytes.NewReader(v.body)
+	if v.gzip {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	return gob.NewDecoder(r).Decode(e)
+}
+
+// afterCacheGet is like afterGet for an entity which has just been decoded
+// from memcache
+func afterCacheGet(e Entity) error {
+	if x, ok := e.(CanSkipCachedGetHook); ok && x.SkipCachedGetHook() {
+		return decrypt(e)
+	}
+	return afterGet(e)
+}
+
+// fitsInCache returns true if memcache will accept a value of this size
+func fitsInCache(key string, value []byte) bool {
+	return len(key)+len(value)+cacheItemOverhead <= maxCacheItemSize
+}
+
+// tooLargeToCache returns true if a value of size n, stored under the given
+// cache key, won't be cached because of its size
+func tooLargeToCache(key string, n int) bool {
+	return len(key)+n+cacheItemOverhead > maxCacheItemSize || MaxCacheSize > 0 && n > MaxCacheSize
+}
+
+// reportCacheError calls OnCacheError, if it's set, and logs the error if
+// MemcacheErrorPolicy asks for it
+func reportCacheError(c context.Context, key *datastore.Key, reason string, err error) {
+	if MemcacheErrorPolicy != MemcacheIgnore && reason != CacheErrorDelete {
+		// failed deletes are always logged by the caller
+		log.Warningf(c, "aeds: memcache %s error for %s: %s", reason, key, err)
+	}
+	if OnCacheError != nil {
+		OnCacheError(c, key, reason, err)
+	}
+}
+
+// cacheTimes calculates how long an entity's memcache item should live and
+// when its value becomes stale (zero if never)
+func cacheTimes(e Entity, ttl time.Duration) (time.Duration, time.Time) {
+	x, ok := e.(CanBeStale)
+	if !ok || x.StaleTtl() <= 0 {
+		return ttl, time.Time{}
+	}
+	return ttl + x.StaleTtl(), time.Now().Add(ttl)
+}
+
+// Note_codec
+//
+// Cached values used to be a bare gob stream, and later a gob stream after a
+// single header byte of flags.  Each feature which needed to describe a value
+// claimed a flag bit, and values without a header were still accepted.  Now
+// every value starts with a version byte, cacheVersionBase plus
+// cacheVersion, followed by a flags byte.  Headers are only written by
+// cacheValue.header and only read by parseCacheValue.  A value with any other
+// version, including a headerless gob stream or a value from the older
+// single byte format, is malformed and treated as a cache miss.  FromId then
+// replaces it with a current value.  Instances running the older format see
+// the version byte as a header with unknown flag bits and treat it as a miss
+// too, so old and new instances can share memcache during a rollout.  A
+// change to the layout below must increment cacheVersion, which stays below
+// 0x38 so that the version byte never looks like the start of a gob stream.
+//
+// If the cacheFreshUntil flag is set, the flags byte is followed by 8 bytes
+// holding a big-endian Unix time in nanoseconds.  If the cacheExpiresAt flag
+// is set, 8 more bytes follow in the same format, holding the time memcache
+// discards the item (memcache itself won't say).  If the cacheTypeHash flag is
+// set, 4 more bytes follow, holding a big-endian type fingerprint.  The gob
+// stream (possibly compressed) comes after the header.  A tombstone is only a
+// header.  See Note_tombstone
+
+// Note_tombstone
+//
+// Delete used to remove an entity's cached value.  A concurrent FromId which
+// had already missed the cache and read the entity from the datastore could
+// then fill the cache after the delete, caching the deleted entity until
+// CacheTtl ran out.  Now Delete overwrites the value with a tombstone, a
+// header with the cacheTombstone flag and nothing else, for
+// tombstoneTtl.  FromId treats a tombstone as a miss but doesn't fill the
+// cache.  After a true miss, it fills the cache with Add (See CanAdd), which
+// fails if a tombstone appeared in the meantime.  Put clears the tombstone
+// like any other cached value, so recreating an entity isn't delayed.
+//
+// Instances without tombstone support see the unknown flag as a malformed
+// value and read from the datastore, which is also correct.
+
+// Note_typehash
+//
+// Memcache keys are derived from datastore keys, which only describe an
+// entity's kind and ID.  If two Go types share a kind (which happens during
+// refactors), one type might find a value cached by the other.  gob happily
+// decodes into a struct with different fields, silently dropping or zeroing
+// data.  Each cached value carries a fingerprint of the Go type that wrote it.
+// A value with the wrong fingerprint is treated as a cache miss.
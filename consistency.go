@@ -0,0 +1,38 @@
+package aeds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type eventualKey struct{}
+
+// WithEventualConsistency returns a copy of c which prefers eventually
+// consistent queries, trading freshness for latency.  The query helpers
+// (AllKeys, ChangedSince, Nearby, kvs.History and friends) honor it via
+// QueryConsistency.
+//
+// It only makes a difference to ancestor queries, like kvs.History, which are
+// otherwise strongly consistent.  Other queries are always eventually
+// consistent.  Lookups by key, including FromId and Get, are always strongly
+// consistent, and so are queries inside a transaction, so neither is
+// affected.
+func WithEventualConsistency(c context.Context) context.Context {
+	return context.WithValue(c, eventualKey{}, true)
+}
+
+// PrefersEventualConsistency returns true if c was made by
+// WithEventualConsistency
+func PrefersEventualConsistency(c context.Context) bool {
+	eventual, _ := c.Value(eventualKey{}).(bool)
+	return eventual
+}
+
+// QueryConsistency applies c's consistency preference to q.  Use it for
+// queries built outside aeds which should follow the same preference.
+func QueryConsistency(c context.Context, q *datastore.Query) *datastore.Query {
+	if PrefersEventualConsistency(c) {
+		return q.EventualConsistency()
+	}
+	return q
+}
@@ -0,0 +1,62 @@
+package aeds
+
+// HasEncryption is implemented by any Entity with fields which must be
+// encrypted before they leave the application.  Encrypt should replace those
+// fields with ciphertext and Decrypt should restore the plaintext.  Both are
+// called automatically.  See Note_encryption
+type HasEncryption interface {
+	Encrypt() error
+	Decrypt() error
+}
+
+// beforePut prepares an entity to be written to datastore or memcache
+func beforePut(e Entity) error {
+	if x, ok := e.(HasPutHook); ok {
+		x.HookBeforePut()
+	}
+	if x, ok := e.(HasEncryption); ok {
+		return x.Encrypt()
+	}
+	return nil
+}
+
+// afterPut restores an entity's plaintext after beforePut and a write
+func afterPut(e Entity) error {
+	return decrypt(e)
+}
+
+// afterGet finishes an entity which has just been read from datastore
+func afterGet(e Entity) error {
+	err := decrypt(e)
+	if err != nil {
+		return err
+	}
+	if x, ok := e.(HasGetHook); ok {
+		x.HookAfterGet()
+	}
+	return nil
+}
+
+func decrypt(e Entity) error {
+	if x, ok := e.(HasEncryption); ok {
+		return x.Decrypt()
+	}
+	return nil
+}
+
+// Note_encryption
+//
+// On the way out, an entity passes through HookBeforePut and then Encrypt.
+// Derived fields are calculated from plaintext and may be encrypted along with
+// everything else.  The encrypted entity is written to datastore.  When an
+// entity is cached, the encrypted entity is also what gets gob encoded, so
+// memcache never holds plaintext either.  Once the bytes are written, Decrypt
+// runs so the caller's entity holds plaintext again.  That happens even if the
+// write fails.
+//
+// On the way in, an entity read from datastore or decoded from memcache
+// passes through Decrypt followed by HookAfterGet.  The hook therefore always
+// sees plaintext.
+//
+// ETag is calculated from plaintext, since Encrypt usually includes a random
+// nonce which would change the tag on every write.
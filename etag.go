@@ -0,0 +1,93 @@
+package aeds
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// HasETag is implemented by any Entity that wants to remember its own ETag.
+// SetETag is called each time aeds reads the entity from datastore or writes
+// it there.  Store the value in an exported field tagged `datastore:"-"`.  The
+// field is then included in cached copies of the entity, so FromId can return
+// the ETag from memcache without recalculating it.
+type HasETag interface {
+	SetETag(etag string)
+}
+
+// ETag calculates an HTTP entity tag describing the state that e has (or would
+// have) in the datastore.  HookBeforePut is executed first so that derived
+// fields contribute to the tag.  Two entities with identical datastore
+// properties always have the same ETag.
+//
+// The result is quoted, as required for an ETag header, so it may be compared
+// directly against the values in an If-None-Match header.
+func ETag(e Entity) (string, error) {
+	if x, ok := e.(HasPutHook); ok {
+		x.HookBeforePut()
+	}
+	return etagOf(e)
+}
+
+// etagOf is ETag without HookBeforePut, for entities whose properties are
+// already as stored, like those just read or written
+func etagOf(e Entity) (string, error) {
+	var props []datastore.Property
+	var err error
+	if x, ok := e.(datastore.PropertyLoadSaver); ok {
+		props, err = x.Save()
+	} else {
+		props, err = datastore.SaveStruct(e)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// See Note_etag
+	h := sha1.New()
+	io.WriteString(h, e.Kind())
+	for _, p := range props {
+		fmt.Fprintf(h, "\x00%s\x00%t\x00%T\x00", p.Name, p.NoIndex, p.Value)
+		switch v := p.Value.(type) {
+		case []byte:
+			h.Write(v)
+		case time.Time:
+			io.WriteString(h, v.UTC().Format(time.RFC3339Nano))
+		case *datastore.Key:
+			if v != nil {
+				io.WriteString(h, v.Encode())
+			}
+		default:
+			fmt.Fprintf(h, "%v", v)
+		}
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum(nil)), nil
+}
+
+// rememberETag calls SetETag, if applicable, with the entity's current ETag.
+// It's called right after reads and writes, so HookBeforePut doesn't run.
+// Reads shouldn't modify the entity, and writes have already run it.
+func rememberETag(e Entity) {
+	x, ok := e.(HasETag)
+	if !ok {
+		return
+	}
+
+	etag, err := etagOf(e)
+	if err == nil {
+		x.SetETag(etag)
+	}
+}
+
+// Note_etag
+//
+// Hashing an entity's gob encoding looks like the obvious approach, but gob
+// writes map entries in Go's randomized iteration order.  It also includes
+// fields which never reach the datastore.  Instead, we hash the property list
+// that datastore would store.  Its order is fixed by the struct definition (or
+// by the entity's Save method) and it contains exactly the state the ETag is
+// supposed to describe.  Times are normalized so that monotonic clock readings
+// and time zones don't change the tag.
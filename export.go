@@ -0,0 +1,201 @@
+package aeds
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Formats understood by Export and ImportFrom
+const (
+	FormatGob  = "gob"
+	FormatJSON = "json"
+)
+
+// maxExportRecord is the largest record ImportFrom accepts.  Datastore
+// entities are limited to 1 MiB, so anything much larger is corrupt.
+const maxExportRecord = 16 << 20
+
+var errExportRecordTooLarge = errors.New("aeds: export record is too large")
+
+// Export writes every entity of the given kind to w and returns how many were
+// written.  proto supplies the entities' Go type and must be a pointer to a
+// struct which implements CanSetStringId, so that each entity gets the id
+// from its key and ImportFrom stores it under the same key.  Each entity is
+// encoded in format (FormatGob or FormatJSON) and preceded by its length as a
+// uvarint.  See ImportFrom for the reverse.
+//
+// Entities are fetched in batches, so memory use stays bounded regardless of
+// the kind's size.  The result isn't a point-in-time snapshot: an entity
+// changed during the export may appear in either state.  HookAfterGet runs
+// and encrypted entities are decrypted, so the output holds plaintext.
+func Export(c context.Context, kind string, proto Entity, w io.Writer, format string) (int, error) {
+	encode, err := exportEncoder(format)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := proto.(CanSetStringId); !ok {
+		return 0, fmt.Errorf("aeds: kind %q does not implement CanSetStringId", kind)
+	}
+
+	n := 0
+	err = AllKeys(c, kind, DefaultBatchSize, func(keys []*datastore.Key) error {
+		es, err := loadEntities(c, keys, proto)
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		var length [binary.MaxVarintLen64]byte
+		for _, e := range es {
+			buf.Reset()
+			err = encode(&buf, e)
+			if err != nil {
+				return err
+			}
+			m := binary.PutUvarint(length[:], uint64(buf.Len()))
+			_, err = w.Write(length[:m])
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(buf.Bytes())
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// ImportFrom reads entities written by Export from r and stores them with
+// PutMulti, one batch at a time.  proto and format must match those given to
+// Export.  Returns the number of entities stored.  Since each entity's key
+// comes from its ID, importing the same data twice overwrites rather than
+// duplicates.
+func ImportFrom(c context.Context, r io.Reader, proto Entity, format string) (int, error) {
+	decode, err := exportDecoder(format)
+	if err != nil {
+		return 0, err
+	}
+
+	br := bufio.NewReader(r)
+	n := 0
+	batch := make([]Entity, 0, DefaultBatchSize)
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if size > maxExportRecord {
+			return n, errExportRecordTooLarge
+		}
+		record := make([]byte, size)
+		_, err = io.ReadFull(br, record)
+		if err != nil {
+			return n, err
+		}
+
+		e := newEntity(proto)
+		err = decode(record, e)
+		if err != nil {
+			return n, err
+		}
+		batch = append(batch, e)
+		if len(batch) == cap(batch) {
+			_, err = PutMulti(c, batch)
+			if err != nil {
+				return n, err
+			}
+			n += len(batch)
+			batch = batch[:0]
+		}
+	}
+
+	if len(batch) > 0 {
+		_, err = PutMulti(c, batch)
+		if err != nil {
+			return n, err
+		}
+		n += len(batch)
+	}
+	return n, nil
+}
+
+func exportEncoder(format string) (func(io.Writer, Entity) error, error) {
+	switch format {
+	case FormatGob:
+		return func(w io.Writer, e Entity) error { return gobError(e, gob.NewEncoder(w).Encode(e)) }, nil
+	case FormatJSON:
+		return func(w io.Writer, e Entity) error { return json.NewEncoder(w).Encode(e) }, nil
+	}
+	return nil, fmt.Errorf("aeds: unknown export format %q", format)
+}
+
+func exportDecoder(format string) (func([]byte, Entity) error, error) {
+	switch format {
+	case FormatGob:
+		return func(b []byte, e Entity) error { return gob.NewDecoder(bytes.NewReader(b)).Decode(e) }, nil
+	case FormatJSON:
+		return func(b []byte, e Entity) error { return json.Unmarshal(b, e) }, nil
+	}
+	return nil, fmt.Errorf("aeds: unknown export format %q", format)
+}
+
+// loadEntities fetches the entities with the given keys into new instances
+// of proto's type, running HookAfterGet.  If the type implements
+// CanSetStringId, each entity's id is set from its key.  Entities which no
+// longer exist are left out.
+func loadEntities(c context.Context, keys []*datastore.Key, proto Entity) ([]Entity, error) {
+	es := make([]Entity, len(keys))
+	for i, key := range keys {
+		es[i] = newEntity(proto)
+		if x, ok := es[i].(CanSetStringId); ok {
+			x.SetStringId(key.StringID())
+		}
+	}
+	err := limited(c, func() error { return datastore.GetMulti(c, keys, es) })
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
+		return nil, err
+	}
+
+	loaded := es[:0]
+	for i, e := range es {
+		if merr != nil && merr[i] != nil {
+			if merr[i] == datastore.ErrNoSuchEntity {
+				continue // deleted since the query ran
+			}
+			if !IsErrFieldMismatch(merr[i]) {
+				return nil, merr[i]
+			}
+		}
+		err := afterGet(e)
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, e)
+	}
+	return loaded, nil
+}
+
+// newEntity returns a new, zero entity of the same type as proto, which must
+// be a pointer
+func newEntity(proto Entity) Entity {
+	t := reflect.TypeOf(proto).Elem()
+	return reflect.New(t).Interface().(Entity)
+}
@@ -0,0 +1,227 @@
+package aeds
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// HasGeoPoint is implemented by any Entity that has a location and wants to
+// be found by Nearby.  Such an entity should also store Geohash(GeoPoint())
+// in an indexed string property, typically calculated in HookBeforePut.
+type HasGeoPoint interface {
+	GeoPoint() appengine.GeoPoint
+}
+
+const (
+	geohashAlphabet     = "0123456789bcdefghjkmnpqrstuvwxyz"
+	geohashMaxPrecision = 12
+	earthRadius         = 6371000.0 // meters
+	metersPerDegree     = earthRadius * math.Pi / 180
+)
+
+// Geohash returns the geohash of a point at full precision.  Points which are
+// near each other usually share a long geohash prefix, which is what makes
+// geohashes useful for proximity queries.
+func Geohash(p appengine.GeoPoint) string {
+	return geohash(p, geohashMaxPrecision)
+}
+
+// Nearby returns all entities of proto's kind located within radius meters of
+// center, ordered from nearest to farthest.  proto must implement HasGeoPoint
+// and CanSetStringId, and field must name the indexed property in which each
+// entity stores its Geohash.
+//
+// Datastore has no native geographic queries.  Instead, Nearby queries the
+// handful of geohash cells covering the search area and discards any results
+// which are actually too far away.  See Note_geohash
+func Nearby(c context.Context, proto Entity, field string, center appengine.GeoPoint, radius float64) ([]Entity, error) {
+	if _, ok := proto.(HasGeoPoint); !ok {
+		return nil, fmt.Errorf("aeds: kind %q does not implement HasGeoPoint", proto.Kind())
+	}
+	if _, ok := proto.(CanSetStringId); !ok {
+		return nil, fmt.Errorf("aeds: kind %q does not implement CanSetStringId", proto.Kind())
+	}
+	typ := reflect.TypeOf(proto).Elem()
+
+	var found []nearbyEntity
+	seen := make(map[string]bool)
+	for _, prefix := range geohashCover(center, radius) {
+		q := datastore.NewQuery(entityKind(c, proto))
+		if prefix != "" {
+			q = q.Filter(field+" >=", prefix).
+				Filter(field+" <", prefix+"\ufffd")
+		}
+		q = QueryConsistency(c, q)
+
+		t := q.Run(c)
+		for {
+			e := reflect.New(typ).Interface().(Entity)
+			key, err := t.Next(e)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil && !IsErrFieldMismatch(err) {
+				return nil, err
+			}
+			if seen[key.String()] {
+				continue
+			}
+			seen[key.String()] = true
+
+			e.(CanSetStringId).SetStringId(key.StringID())
+			err = afterGet(e)
+			if err != nil {
+				return nil, err
+			}
+			d := distance(center, e.(HasGeoPoint).GeoPoint())
+			if d <= radius {
+				found = append(found, nearbyEntity{e, d})
+			}
+		}
+	}
+
+	sort.Sort(byDistance(found))
+	es := make([]Entity, len(found))
+	for i := range found {
+		es[i] = found[i].entity
+	}
+	return es, nil
+}
+
+type nearbyEntity struct {
+	entity   Entity
+	distance float64
+}
+
+type byDistance []nearbyEntity
+
+func (s byDistance) Len() int           { return len(s) }
+func (s byDistance) Less(i, j int) bool { return s[i].distance < s[j].distance }
+func (s byDistance) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// geohash encodes a point with the given number of characters
+func geohash(p appengine.GeoPoint, precision int) string {
+	latLo, latHi := -90.0, 90.0
+	lngLo, lngHi := -180.0, 180.0
+
+	hash := make([]byte, 0, precision)
+	even := true // even bits encode longitude, odd ones latitude
+	bits, ch := 0, 0
+	for len(hash) < precision {
+		ch <<= 1
+		if even {
+			mid := (lngLo + lngHi) / 2
+			if p.Lng >= mid {
+				ch |= 1
+				lngLo = mid
+			} else {
+				lngHi = mid
+			}
+		} else {
+			mid := (latLo + latHi) / 2
+			if p.Lat >= mid {
+				ch |= 1
+				latLo = mid
+			} else {
+				latHi = mid
+			}
+		}
+		even = !even
+
+		bits++
+		if bits == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bits, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// geohashCellSize returns the height and width, in degrees, of a geohash cell
+// with the given precision
+func geohashCellSize(precision int) (float64, float64) {
+	bits := uint(5 * precision)
+	latBits := bits / 2
+	lngBits := bits - latBits
+	return 180 / float64(uint64(1)<<latBits), 360 / float64(uint64(1)<<lngBits)
+}
+
+// geohashCover returns geohash prefixes for cells which together cover every
+// point within radius meters of center
+func geohashCover(center appengine.GeoPoint, radius float64) []string {
+	// the farther from the equator, the narrower a cell
+	lat := math.Min(math.Abs(center.Lat)+radius/metersPerDegree, 90)
+	cos := math.Cos(lat * math.Pi / 180)
+
+	// find the longest prefix whose cells are at least radius across
+	precision := 0
+	for p := geohashMaxPrecision; p > 0; p-- {
+		latDeg, lngDeg := geohashCellSize(p)
+		if latDeg*metersPerDegree >= radius && lngDeg*metersPerDegree*cos >= radius {
+			precision = p
+			break
+		}
+	}
+	if precision == 0 {
+		return []string{""} // search area is huge. look everywhere
+	}
+
+	// the center's cell plus its 8 neighbors
+	latDeg, lngDeg := geohashCellSize(precision)
+	var prefixes []string
+	seen := make(map[string]bool)
+	for dLat := -1.0; dLat <= 1; dLat++ {
+		for dLng := -1.0; dLng <= 1; dLng++ {
+			p := appengine.GeoPoint{
+				Lat: math.Max(-90, math.Min(90, center.Lat+dLat*latDeg)),
+				Lng: wrapLongitude(center.Lng + dLng*lngDeg),
+			}
+			prefix := geohash(p, precision)
+			if !seen[prefix] {
+				seen[prefix] = true
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	return prefixes
+}
+
+// wrapLongitude normalizes a longitude into the range [-180, 180)
+func wrapLongitude(lng float64) float64 {
+	lng = math.Mod(lng+180, 360)
+	if lng < 0 {
+		lng += 360
+	}
+	return lng - 180
+}
+
+// distance returns the great-circle distance between two points in meters
+func distance(a, b appengine.GeoPoint) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Note_geohash
+//
+// A geohash cell of a given precision is a fixed rectangle of latitude and
+// longitude.  Every entity inside that cell has a geohash starting with the
+// cell's prefix, so a single range query on the geohash property finds them
+// all.
+//
+// We pick the smallest cells which are still at least radius tall and wide.
+// The search circle then can't extend beyond the center's cell and its eight
+// neighbors, so nine range queries cover it.  Those cells also cover plenty
+// of area outside the circle, which is why results are filtered by their
+// actual distance before being returned.
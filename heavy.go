@@ -0,0 +1,121 @@
+package aeds
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// HasHeavyField is implemented by any Entity with a large field it rarely
+// needs.  That field is stored in a separate companion entity, so that FromId
+// and the cache only deal with the rest.  Call LoadHeavy to fetch it.  See
+// Note_heavy
+type HasHeavyField interface {
+	// HeavyField returns a pointer to the entity's Heavy field.  The field
+	// must be tagged `datastore:"-"`.
+	HeavyField() *Heavy
+}
+
+// Heavy holds a large value which is stored apart from its entity.  It's
+// never written to the cache.  The zero value hasn't been loaded.
+type Heavy struct {
+	value  []byte
+	loaded bool
+}
+
+// Bytes returns the value, which is nil until LoadHeavy or Set is called
+func (h *Heavy) Bytes() []byte {
+	return h.value
+}
+
+// Loaded returns true if the value was loaded with LoadHeavy or given by Set
+func (h *Heavy) Loaded() bool {
+	return h.loaded
+}
+
+// Set replaces the value.  The next Put stores it.
+func (h *Heavy) Set(value []byte) {
+	h.value = value
+	h.loaded = true
+}
+
+// GobEncode leaves the value out of cached entities
+func (h *Heavy) GobEncode() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// GobDecode leaves a cached entity's value unloaded
+func (h *Heavy) GobDecode([]byte) error {
+	*h = Heavy{}
+	return nil
+}
+
+// HeavyKind is the datastore kind of the companion entities holding Heavy
+// values.  Each one is a child of its entity.
+var HeavyKind = "AedsHeavy"
+
+// heavyEntity is the companion entity for a Heavy value
+type heavyEntity struct {
+	Value []byte `datastore:",noindex"`
+}
+
+// heavyKey returns the key of the companion entity for the entity with key
+// parent
+func heavyKey(c context.Context, parent *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, HeavyKind, "", 1, parent)
+}
+
+// LoadHeavy fetches an entity's Heavy field from its companion entity.  e
+// only needs enough data to calculate its key.  If nothing has been stored,
+// the value is empty.
+func LoadHeavy(c context.Context, e Entity) error {
+	x, ok := e.(HasHeavyField)
+	if !ok {
+		return fmt.Errorf("aeds: %s has no heavy field", e.Kind())
+	}
+
+	var h heavyEntity
+	err := limited(c, func() error { return datastore.Get(c, heavyKey(c, Key(c, e)), &h) })
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	*x.HeavyField() = Heavy{value: h.Value, loaded: true}
+	return nil
+}
+
+// putHeavy stores the loaded Heavy fields of the given entities
+func putHeavy(c context.Context, es []Entity) error {
+	var hKeys []*datastore.Key
+	var hs []*heavyEntity
+	for _, e := range es {
+		x, ok := e.(HasHeavyField)
+		if !ok || !x.HeavyField().loaded {
+			continue
+		}
+		hKeys = append(hKeys, heavyKey(c, Key(c, e)))
+		hs = append(hs, &heavyEntity{Value: x.HeavyField().value})
+	}
+	if len(hKeys) == 0 {
+		return nil
+	}
+
+	return batchCall(len(hKeys), maxPutBatch, func(lo, hi int) error {
+		return limited(c, func() error {
+			_, err := datastore.PutMulti(c, hKeys[lo:hi], hs[lo:hi])
+			return err
+		})
+	})
+}
+
+// Note_heavy
+//
+// The companion entity is a child of its entity, so both share an entity
+// group and PutGetOld, PutTx and Modify write them in one transaction.  Put
+// and PutMulti write companions just before their entities, so a failed
+// entity write can leave a new Heavy value next to the old entity.  Only a
+// loaded Heavy value is written.  An entity read by FromId has an unloaded
+// Heavy, so putting it back leaves the stored value alone.  Delete, DeleteTx
+// and DeleteAllOf remove the companion along with its entity.
+// DeleteAllOfKind can't tell whether the kind has heavy fields, so it leaves
+// companions behind.
@@ -0,0 +1,72 @@
+package aeds
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// IdGenerator creates IDs for new entities which have no natural key.
+type IdGenerator interface {
+	NewId() (string, error)
+}
+
+// DefaultIdGenerator is used by Create.  It defaults to Ulid.  Replace it
+// during initialization to generate IDs some other way, such as UUIDs.
+var DefaultIdGenerator IdGenerator = Ulid{}
+
+// Ulid generates ULIDs: 26 character IDs made of a millisecond timestamp
+// followed by 80 random bits.  They sort by creation time, so entities keyed
+// by them page nicely in key order.  IDs created in the same millisecond sort
+// randomly.
+type Ulid struct{}
+
+// Crockford's base 32, as used by ULIDs
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (Ulid) NewId() (string, error) {
+	var b [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint64(b[:8], ms<<16) // 48 bit timestamp
+	_, err := rand.Read(b[6:])
+	if err != nil {
+		return "", err
+	}
+
+	// 26 characters hold 130 bits, so the first two are always zero
+	var id [26]byte
+	for i := range id {
+		var v byte
+		for bit := i*5 - 2; bit < i*5+3; bit++ {
+			v <<= 1
+			if bit >= 0 && b[bit/8]&(0x80>>uint(bit%8)) != 0 {
+				v |= 1
+			}
+		}
+		id[i] = ulidAlphabet[v]
+	}
+	return string(id[:]), nil
+}
+
+// Create stores a new entity, first giving it an ID from DefaultIdGenerator
+// if it doesn't have one.  The entity must implement CanSetStringId.
+// Otherwise Create is exactly like Put.
+func Create(c context.Context, e Entity) (*datastore.Key, error) {
+	if e.StringId() == "" {
+		x, ok := e.(CanSetStringId)
+		if !ok {
+			return nil, fmt.Errorf("aeds: kind %q does not implement CanSetStringId", e.Kind())
+		}
+		id, err := DefaultIdGenerator.NewId()
+		if err != nil {
+			return nil, err
+		}
+		x.SetStringId(id)
+	}
+
+	return Put(c, e)
+}
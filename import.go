@@ -0,0 +1,119 @@
+package aeds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// ImportOptions controls the behavior of Import.
+type ImportOptions struct {
+	// Name uniquely identifies this import.  Its progress is recorded under
+	// this name so that running it again resumes where it left off.
+	Name string
+
+	// ChunkSize is the number of entities written by each PutMulti call.
+	// Datastore allows at most 500.
+	//
+	// Defaults to DefaultBatchSize.
+	ChunkSize int
+}
+
+// ImportResult describes the outcome of an Import.
+type ImportResult struct {
+	// Written is the number of entities stored by this call.
+	Written int
+
+	// Skipped is the number of entities which an earlier call had already
+	// stored.
+	Skipped int
+
+	// Failed is the number of entities which couldn't be stored.
+	Failed int
+
+	// Errors maps an index into the imported slice to the error which
+	// prevented that entity from being stored.
+	Errors map[int]error
+}
+
+// importCheckpoint records how many chunks of an import are complete
+type importCheckpoint struct {
+	Name    string    `datastore:",noindex"`
+	Chunks  int64     `datastore:",noindex"`
+	Updated time.Time `datastore:",noindex"`
+}
+
+// Import stores many entities with PutMulti, one chunk at a time, recording
+// its progress in the datastore within the kind "imports".  If an import is
+// interrupted, call Import again with the same entities in the same order and
+// the same options.  Chunks which were already stored are skipped.
+//
+// Entities which fail individually are reported in the result rather than
+// aborting the import.  The recorded progress never advances past a chunk
+// containing a failure, so a later call retries it.  Since each entity's key
+// comes from its ID, rewriting a chunk overwrites entities rather than
+// duplicating them.
+//
+// Any other error stops the import and is returned along with the counts so
+// far.
+func Import(c context.Context, es []Entity, opts ImportOptions) (ImportResult, error) {
+	result := ImportResult{Errors: make(map[int]error)}
+	size := opts.ChunkSize
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+
+	// where did we leave off?
+	cpKey := datastore.NewKey(c, "imports", opts.Name, 0, nil)
+	cp := importCheckpoint{Name: opts.Name}
+	err := datastore.Get(c, cpKey, &cp)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return result, err
+	}
+
+	complete := true // have all chunks so far been stored?
+	for start := 0; start < len(es); start += size {
+		end := start + size
+		if end > len(es) {
+			end = len(es)
+		}
+		chunk := es[start:end]
+		n := int64(start / size)
+		if n < cp.Chunks {
+			result.Skipped += len(chunk)
+			continue
+		}
+
+		_, err := PutMulti(c, chunk)
+		if merr := multiError(err); merr != nil {
+			failed := 0
+			for i, err := range merr {
+				if err != nil {
+					failed++
+					result.Errors[start+i] = err
+				}
+			}
+			result.Failed += failed
+			result.Written += len(chunk) - failed
+			complete = false
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Written += len(chunk)
+
+		// record our progress
+		if complete {
+			cp.Chunks = n + 1
+			cp.Updated = time.Now()
+			_, err = datastore.Put(c, cpKey, &cp)
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+
+	return result, nil
+}
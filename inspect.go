@@ -0,0 +1,155 @@
+package aeds
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// InspectResult describes what the datastore and the cache each hold for an
+// entity.  See Inspect
+type InspectResult struct {
+	CacheKey string // memcache key for the entity
+
+	// Datastore is the entity as stored in the datastore, or nil if it
+	// doesn't exist there.
+	Datastore Entity
+
+	// Cached is the entity decoded from its cached value, or nil if there's
+	// no usable cached value.  CachedValue holds the raw bytes, if any.
+	Cached      Entity
+	CachedValue []byte
+	Tombstone   bool      // cached value marks a recently deleted entity
+	Stale       bool      // cached value is past its freshness deadline
+	ExpiresAt   time.Time // when memcache drops the value.  zero if unknown
+	CacheErr    error     // why an existing cached value couldn't be decoded
+
+	// Match is true if both copies exist and hold the same data, or if
+	// neither exists.  Otherwise, Reason explains the difference.
+	Match  bool
+	Reason string
+}
+
+// Inspect reads an entity from both the datastore and the cache, without
+// changing either, and reports whether they agree.  e supplies the entity's
+// type and ID and isn't modified.  It's a diagnostic for chasing stale cache
+// bugs, not something to call on a request's hot path.
+//
+// Both copies run through the entity's HookAfterGet (or its cached
+// equivalent) before they're compared.  The datastore copy is first round
+// tripped through gob, like a cached value, so that differences which gob
+// can't represent (like an empty slice vs a nil one) aren't reported.
+func Inspect(c context.Context, e Entity) (InspectResult, error) {
+	key := Key(c, e)
+	r := InspectResult{CacheKey: entityCacheKey(key, e)}
+
+	// datastore copy
+	d := blankCopy(e)
+	err := datastore.Get(c, key, d)
+	if err == nil || IsErrFieldMismatch(err) {
+		err = afterGet(d)
+		if err != nil {
+			return r, err
+		}
+		r.Datastore = d
+	} else if err != datastore.ErrNoSuchEntity {
+		return r, err
+	}
+
+	// cached copy
+	item, err := CacheBackend.Get(c, r.CacheKey)
+	if err != nil && err != memcache.ErrCacheMiss {
+		return r, err
+	}
+	if err == nil {
+		r.CachedValue = item.Value
+		r.CacheErr = inspectCached(&r, e, item.Value)
+	}
+
+	// compare
+	switch {
+	case r.Datastore == nil && (r.CachedValue == nil || r.Tombstone):
+		r.Match = true
+	case r.Datastore == nil:
+		r.Reason = "cached but not in the datastore"
+	case r.CachedValue == nil:
+		r.Reason = "not cached"
+	case r.Tombstone:
+		r.Reason = "deleted recently but still in the datastore"
+	case r.CacheErr != nil:
+		r.Reason = "cached value is unusable: " + r.CacheErr.Error()
+	default:
+		same, err := sameAfterGob(e, r.Datastore, r.Cached)
+		if err != nil {
+			return r, err
+		}
+		r.Match = same
+		if !same {
+			r.Reason = "cached value differs from the datastore"
+		}
+	}
+	return r, nil
+}
+
+// inspectCached decodes a cached value for Inspect
+func inspectCached(r *InspectResult, e Entity, value []byte) error {
+	v, err := parseCacheValue(value)
+	if err != nil {
+		return err
+	}
+	r.Tombstone = v.tombstone
+	if v.tombstone {
+		return nil
+	}
+	r.Stale = v.isStale()
+	r.ExpiresAt = v.expiresAt
+	if !v.fits(e) {
+		return errBadCacheValue // See Note_typehash
+	}
+
+	cached := blankCopy(e)
+	err = v.decode(cached)
+	if err != nil {
+		return err
+	}
+	err = afterCacheGet(cached)
+	if err != nil {
+		return err
+	}
+	r.Cached = cached
+	return nil
+}
+
+// sameAfterGob returns true if a, after a trip through gob, deeply equals b.
+// Like the cached copy, a is decoded into a blank copy of e.
+func sameAfterGob(e, a, b Entity) (bool, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(a)
+	if err != nil {
+		return false, gobError(a, err)
+	}
+	x := blankCopy(e)
+	err = gob.NewDecoder(&buf).Decode(x)
+	if err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(x, b), nil
+}
+
+// blankCopy returns a new entity of e's type with only e's ID, ready to be
+// loaded like FromId would load it.  Nothing is shared with e.
+func blankCopy(e Entity) Entity {
+	x := newEntity(e)
+	if s, ok := x.(CanSetStringId); ok {
+		s.SetStringId(e.StringId())
+	}
+	if r, ok := x.(NeedsIdempotentReset); ok {
+		r.IdempotentReset()
+	}
+	return x
+}
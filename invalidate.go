@@ -0,0 +1,123 @@
+package aeds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// HasCacheDependencies is implemented by any Entity whose changes make other
+// cached entities stale.  For example, a comment might return the post whose
+// cached comment count it affects.  After Put, Modify or Delete, the caches of
+// those entities are cleared by a background task rather than during the
+// request.
+type HasCacheDependencies interface {
+	// CacheDependencies returns the entities whose cache entries should be
+	// cleared.  Each one only needs enough data to calculate its key.
+	CacheDependencies() []Entity
+}
+
+// OnMutate, if not nil, is called whenever aeds writes or deletes an entity.
+// It's intended for keeping caches outside of memcache coherent, for example
+// by publishing the key so that other instances drop their local copies.
+//
+// OnMutate is called after the datastore operation succeeds and after aeds
+// has cleared the entity from memcache (whether or not that worked).  It's
+// not called for failed operations.  op is one of the Mutation constants.
+// Actor(c) reports who made the change, if the caller used WithActor.
+var OnMutate func(c context.Context, key *datastore.Key, op string)
+
+// Operations reported to OnMutate
+const (
+	MutationPut    = "put"    // Put, PutMulti or Modify stored the entity
+	MutationDelete = "delete" // Delete or DeleteAllOfKind removed the entity
+)
+
+// reportMutation calls OnMutate, if it's set
+func reportMutation(c context.Context, key *datastore.Key, op string) {
+	if OnMutate != nil {
+		OnMutate(c, key, op)
+	}
+}
+
+// invalidateLater clears cache entries in a task queue task.  The delay
+// package provides the task handler.
+var invalidateLater = delay.Func("aeds.invalidate", func(c context.Context, cacheKeys []string) error {
+	return deleteCacheKeys(c, cacheKeys)
+})
+
+// InvalidateLater enqueues a task which clears the cache entries for the
+// given entities.  It's useful when many caches must be cleared and doing so
+// synchronously would add too much latency.  The task runs on the default
+// queue via the delay package, so an app using it must route /_ah/queue/go/delay
+// to the Go runtime (which is the default).
+func InvalidateLater(c context.Context, es ...Entity) error {
+	cacheKeys := cacheKeysOf(c, es)
+	if len(cacheKeys) == 0 {
+		return nil
+	}
+
+	return invalidateLater.Call(c, cacheKeys)
+}
+
+// InvalidateMulti clears the cache entries for the given entities right
+// away.  It's the batch equivalent of ClearCache, for reconciling the cache
+// after the datastore was changed outside of aeds, like with a raw
+// datastore.DeleteMulti.  Entities which aren't cached are not an error.
+func InvalidateMulti(c context.Context, es []Entity) error {
+	cacheKeys := cacheKeysOf(c, es)
+	if len(cacheKeys) == 0 {
+		return nil
+	}
+
+	end := startSpan(c, "cache.DeleteMulti", multiKind(es))
+	defer end()
+	return deleteCacheKeys(c, cacheKeys)
+}
+
+// cacheKeysOf returns the cache keys of those entities which can be cached
+func cacheKeysOf(c context.Context, es []Entity) []string {
+	var cacheKeys []string
+	for _, e := range es {
+		if canBeCached(e) {
+			cacheKeys = append(cacheKeys, entityCacheKey(Key(c, e), e))
+		}
+	}
+	return cacheKeys
+}
+
+// invalidateDependencies enqueues invalidation of an entity's cache
+// dependencies, if it has any
+func invalidateDependencies(c context.Context, e Entity) {
+	x, ok := e.(HasCacheDependencies)
+	if !ok {
+		return
+	}
+
+	err := InvalidateLater(c, x.CacheDependencies()...)
+	if err != nil {
+		log.Errorf(c, "aeds: can't enqueue invalidation for dependencies of %s: %s", Key(c, e), err)
+	}
+}
+
+// deleteCacheKeys removes several items from the cache.  Missing items are
+// not an error.
+func deleteCacheKeys(c context.Context, cacheKeys []string) error {
+	err := batchCall(len(cacheKeys), maxGetBatch, func(lo, hi int) error {
+		return CacheBackend.DeleteMulti(c, cacheKeys[lo:hi])
+	})
+	merr, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+
+	for _, err := range merr {
+		if err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
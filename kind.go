@@ -0,0 +1,47 @@
+package aeds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type kindOverrideKey struct{}
+
+// kindOverride stores entities of kind from in kind to instead
+type kindOverride struct {
+	from, to string
+}
+
+// PutToKind is like Put but stores e in the given kind instead of e.Kind().
+// It's meant for blue/green migrations and shadow kinds, where one type is
+// temporarily written to a second kind.  Read it back with FromIdInKind.
+func PutToKind(c context.Context, e Entity, kind string) (*datastore.Key, error) {
+	return Put(withKind(c, e, kind), e)
+}
+
+// FromIdInKind is like FromId but reads e from the given kind instead of
+// e.Kind().  Its cache entry is separate from the one for e.Kind().
+func FromIdInKind(c context.Context, e Entity, kind string) (Entity, error) {
+	return FromId(withKind(c, e, kind), e)
+}
+
+// withKind returns a copy of c in which entities of e's kind are stored in
+// kind instead.  Key, and everything derived from it, honors the override.
+func withKind(c context.Context, e Entity, kind string) context.Context {
+	return context.WithValue(c, kindOverrideKey{}, kindOverride{from: e.Kind(), to: kind})
+}
+
+// entityKind returns the kind e is stored in, given any override in c
+func entityKind(c context.Context, e Entity) string {
+	o, ok := c.Value(kindOverrideKey{}).(kindOverride)
+	if ok && o.from == e.Kind() {
+		return o.to
+	}
+	return e.Kind()
+}
+
+// kindOverridden returns true if c stores e somewhere other than e.Kind().
+// Background tasks don't inherit the override, so they're skipped.
+func kindOverridden(c context.Context, e Entity) bool {
+	return entityKind(c, e) != e.Kind()
+}
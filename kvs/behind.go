@@ -0,0 +1,175 @@
+package kvs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/jjhendricks/aeds"
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/memcache"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// WriteBehindDelay is how long PutLater waits before persisting a KV to the
+// datastore.  Every PutLater for the same key during that time is persisted by
+// a single datastore write.
+var WriteBehindDelay = 10 * time.Second
+
+// persistLater copies a pending KV from memcache to the datastore.  The delay
+// package provides the task handler.
+var persistLater = delay.Func("kvs.persist", func(c context.Context, k string) error {
+	return persist(c, k)
+})
+
+// PutLater is like Put but only writes to memcache immediately.  The KV is
+// copied to the datastore after WriteBehindDelay by a task queue task.  See
+// Note_behind
+//
+// Use it for data which is written often and which can tolerate loss.  Until
+// the task runs, memcache holds the only copy, so an eviction or memcache
+// outage loses the write.  Find sees the new value right away, as long as it
+// stays in memcache.
+//
+// Like Put and Modify, PutLater shouldn't be mixed with other writes to the
+// same key.  A pending write can overwrite a later Put or Modify.  Delete is
+// safe.
+func (kv *KV) PutLater(c context.Context) error {
+	if aeds.IsReadOnly() {
+		return aeds.ErrReadOnly
+	}
+	err := kv.checkExpiration()
+	if err != nil {
+		return err
+	}
+
+	item := kv.memcacheItem()
+	stored := *kv
+	stored.Value, err = sealValue(kv.Key, kv.Value)
+	if err != nil {
+		return err
+	}
+	stored.Value, err = storeValue(c, kv.Key, stored.Value)
+	if err != nil {
+		return err
+	}
+	item.Value = stored.Value
+
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(&stored)
+	if err != nil {
+		replaceBlob(c, stored.Value, nil)
+		return err
+	}
+	pending := &memcache.Item{
+		Key:        pendingKey(kv.Key),
+		Value:      buf.Bytes(),
+		Expiration: item.Expiration,
+	}
+
+	// memcache is the only copy, so errors matter this time
+	err = memcache.SetMulti(c, []*memcache.Item{item, pending})
+	if err != nil {
+		replaceBlob(c, stored.Value, nil)
+		return err
+	}
+
+	// schedule a flush, unless one is already scheduled
+	err = memcache.Add(c, &memcache.Item{
+		Key:        flushKey(kv.Key),
+		Value:      []byte{},
+		Expiration: 2 * WriteBehindDelay, // in case the task never runs
+	})
+	if err == memcache.ErrNotStored {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t, err := persistLater.Task(kv.Key)
+	if err == nil {
+		t.Delay = WriteBehindDelay
+		_, err = taskqueue.Add(c, t, "")
+	}
+	if err != nil {
+		_ = memcache.Delete(c, flushKey(kv.Key)) // let the next write try again
+		return err
+	}
+	return nil
+}
+
+// persist writes a pending KV to the datastore
+func persist(c context.Context, k string) error {
+	if aeds.IsReadOnly() {
+		return aeds.ErrReadOnly // retry the task later
+	}
+
+	// writes from now on schedule another flush
+	err := memcache.Delete(c, flushKey(k))
+	if err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+
+	item, err := memcache.Get(c, pendingKey(k))
+	if err == memcache.ErrCacheMiss {
+		return nil // deleted, expired or evicted
+	}
+	if err != nil {
+		return err
+	}
+	var kv KV
+	err = gob.NewDecoder(bytes.NewReader(item.Value)).Decode(&kv)
+	if err != nil {
+		return err
+	}
+	if kv.isExpired() {
+		return nil
+	}
+
+	err = filterAdd(c, k)
+	if err != nil {
+		return err
+	}
+	key := datastore.NewKey(c, Kind, k, 0, nil)
+	old := storedValues(c, []*datastore.Key{key})
+	_, err = datastore.Put(c, key, &kv)
+	if err != nil {
+		return err // the task retries with the same value
+	}
+	if old != nil {
+		replaceBlob(c, old[0], kv.Value)
+	}
+	return nil
+}
+
+// returns the memcache key holding a KV waiting to be persisted
+func pendingKey(key string) string {
+	return fmt.Sprintf("%s pending: %s", Kind, key)
+}
+
+// returns the memcache key which marks that a flush is scheduled
+func flushKey(key string) string {
+	return fmt.Sprintf("%s flush: %s", Kind, key)
+}
+
+// Note_behind
+//
+// PutLater stores two memcache items: the usual one read by Find, and a
+// pending copy which also records the expiration time.  It then adds a flush
+// marker.  Only the write which manages to add the marker enqueues a task, so
+// a burst of writes to one key costs a single datastore write.
+//
+// The task deletes the marker before reading the pending copy, while writers
+// store the pending copy before adding the marker.  So a write whose value
+// lands after the task's read adds its marker after the task deleted it, and
+// schedules a new flush.  Either way, the newest value is eventually
+// persisted.
+//
+// A large value is offloaded to Blobs by PutLater, so that both memcache
+// items stay small.  The task removes the object of the value it replaces in
+// the datastore.  Objects of values overwritten before any task persisted them
+// are orphaned, which is harmless.  See Note_blobs
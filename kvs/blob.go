@@ -0,0 +1,124 @@
+package kvs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// BlobStore stores large values outside the datastore, for example in Cloud
+// Storage.  Implementations are expected to be thin wrappers around a
+// storage client.  Delete must not report an error for a missing object.
+type BlobStore interface {
+	Write(c context.Context, name string, data []byte) error
+	Read(c context.Context, name string) ([]byte, error)
+	Delete(c context.Context, name string) error
+}
+
+// Blobs enables offloading of large values.  When it's set, Put and Modify
+// write any value larger than BlobThreshold to Blobs and store only the
+// object's name in the datastore and memcache.  Find reads such values back
+// transparently.  Objects are removed when their KV is overwritten, deleted
+// or garbage collected.  nil, the default, keeps every value inline.  See
+// Note_blobs
+//
+// PutLater and PutWithHistory always store values inline, though
+// PutWithHistory keeps an offloaded previous value in the history until it's
+// trimmed.
+//
+// Set it once during initialization.
+var Blobs BlobStore
+
+// BlobThreshold is the size, in bytes, above which values are offloaded to
+// Blobs.  Values are measured after encryption.
+var BlobThreshold = 512 << 10
+
+// marks a value which is stored in Blobs.  The object's name follows.
+var blobMarker = []byte("\x00kvs:blob\x00")
+
+// storeValue offloads a sealed value to Blobs, if it's large enough, and
+// returns what should be stored in its place
+func storeValue(c context.Context, k string, value []byte) ([]byte, error) {
+	if Blobs == nil || len(value) <= BlobThreshold {
+		return value, nil
+	}
+
+	var suffix [8]byte
+	_, err := rand.Read(suffix[:])
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(k))
+	name := fmt.Sprintf("%s/%s/%s", Kind, hex.EncodeToString(hash[:]), hex.EncodeToString(suffix[:]))
+	err = Blobs.Write(c, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), blobMarker...), name...), nil
+}
+
+// loadValue reverses storeValue
+func loadValue(c context.Context, value []byte) ([]byte, error) {
+	name := blobName(value)
+	if name == "" {
+		return value, nil
+	}
+	if Blobs == nil {
+		return nil, fmt.Errorf("kvs: value is stored in blob %s but Blobs is nil", name)
+	}
+	return Blobs.Read(c, name)
+}
+
+// blobName returns the name of the object holding a stored value, or "" if
+// the value is inline
+func blobName(value []byte) string {
+	if !bytes.HasPrefix(value, blobMarker) {
+		return ""
+	}
+	return string(value[len(blobMarker):])
+}
+
+// replaceBlob removes the object referred to by an old stored value, unless
+// the new stored value refers to the same object
+func replaceBlob(c context.Context, old, new []byte) {
+	name := blobName(old)
+	if name == "" || Blobs == nil || name == blobName(new) {
+		return
+	}
+	err := Blobs.Delete(c, name)
+	_ = err // leaves an orphaned object, which is harmless
+}
+
+// storedValues returns the raw stored values of the KVs with the given keys,
+// if offloading is enabled.  Missing KVs have nil values.  Errors are
+// ignored, since the values are only needed to clean up objects.
+func storedValues(c context.Context, keys []*datastore.Key) [][]byte {
+	if Blobs == nil {
+		return nil
+	}
+
+	kvs := make([]KV, len(keys))
+	err := datastore.GetMulti(c, keys, kvs)
+	_ = err // missing values are simply nil
+	values := make([][]byte, len(keys))
+	for i := range kvs {
+		values[i] = kvs[i].Value
+	}
+	return values
+}
+
+// Note_blobs
+//
+// The datastore limits entities to 1 MiB, so a large value is written to
+// Blobs under a new, random name and the KV stores a marker followed by that
+// name.  Since old and new objects never share a name, a failed write or an
+// aborted transaction can't expose a value which was never committed.  The
+// old object is removed only after the new value has been stored, which may
+// briefly leave readers holding a name whose object is gone.  They fail with
+// the BlobStore's error rather than returning the wrong value.
@@ -0,0 +1,350 @@
+package kvs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// Filter enables a Bloom filter, kept in memcache, which lets FindMulti skip
+// the datastore for keys that definitely don't exist.  Writes add their keys
+// to the filter.  nil, the default, disables it.  See Note_bloom
+//
+// Set it once during initialization.  Enabling it or changing its settings
+// only takes effect after RebuildFilter runs, which must wait until every
+// instance is running with the same settings.
+var Filter *BloomFilter
+
+// BloomFilter describes the size of the filter.  The filter is split into
+// Shards memcache items of Bits bits each.  With n keys, the chance of a
+// false positive is roughly (1 - e^(-Hashes*n/(Shards*Bits)))^Hashes.
+type BloomFilter struct {
+	// Shards is the number of memcache items holding the filter.
+	//
+	// Defaults to 64.
+	Shards int
+
+	// Bits is the size of each shard.  Every write reads and rewrites one
+	// shard per key, so smaller shards make writes cheaper.  It may not
+	// exceed MaxFilterBits.
+	//
+	// Defaults to 1<<20, which is 128 KiB.
+	Bits int
+
+	// Hashes is the number of bits set for each key.
+	//
+	// Defaults to 7.
+	Hashes int
+}
+
+// MaxFilterBits is the largest shard that fits in a memcache item
+const MaxFilterBits = 1000 << 13
+
+// header of a filter shard: a flags byte then the creation time in Unix
+// nanoseconds
+const (
+	filterComplete byte = 0x01 // shard holds every key.  See Note_bloom
+	filterHeader        = 9
+)
+
+// filterSettle is how long a shard must exist before RebuildFilter trusts a
+// scan to have seen every key written before it.  Queries are eventually
+// consistent.
+const filterSettle = 30 * time.Second
+
+// filterCASAttempts bounds retries when concurrent writers update one shard
+const filterCASAttempts = 5
+
+var errFilterContention = errors.New("kvs: too much contention updating filter")
+var errBadFilter = errors.New("kvs: malformed filter shard")
+
+func (f *BloomFilter) shards() int {
+	if f.Shards <= 0 {
+		return 64
+	}
+	return f.Shards
+}
+
+func (f *BloomFilter) bits() int {
+	if f.Bits <= 0 {
+		return 1 << 20
+	}
+	return f.Bits
+}
+
+func (f *BloomFilter) hashes() int {
+	if f.Hashes <= 0 {
+		return 7
+	}
+	return f.Hashes
+}
+
+// shardKey returns the memcache key of a shard.  The settings are part of the
+// key, so shards built with other settings are ignored.
+func (f *BloomFilter) shardKey(shard int) string {
+	return fmt.Sprintf("%s bloom %d/%d/%d: %d", Kind, f.shards(), f.bits(), f.hashes(), shard)
+}
+
+// positions returns the shard holding key k and the bits it sets there
+func (f *BloomFilter) positions(k string) (int, []int) {
+	sum := sha256.Sum256([]byte(k))
+	shard := binary.BigEndian.Uint64(sum[0:8]) % uint64(f.shards())
+	h1 := binary.BigEndian.Uint64(sum[8:16])
+	h2 := binary.BigEndian.Uint64(sum[16:24]) | 1
+	bits := make([]int, f.hashes())
+	for i := range bits {
+		bits[i] = int((h1 + uint64(i)*h2) % uint64(f.bits()))
+	}
+	return int(shard), bits
+}
+
+// newShard returns the value of an empty, incomplete shard
+func (f *BloomFilter) newShard() []byte {
+	value := make([]byte, filterHeader+(f.bits()+7)/8)
+	binary.BigEndian.PutUint64(value[1:filterHeader], uint64(time.Now().UnixNano()))
+	return value
+}
+
+// validShard returns true if value is a shard built with these settings
+func (f *BloomFilter) validShard(value []byte) bool {
+	return len(value) == filterHeader+(f.bits()+7)/8
+}
+
+// filterAdd records keys in the filter before they're written.  A shard which
+// can't be updated is removed, so that readers stop trusting it.  Only if
+// that fails too is an error returned, since the filter would otherwise deny
+// that the keys exist.
+func filterAdd(c context.Context, keys ...string) error {
+	f := Filter
+	if f == nil || f.bits() > MaxFilterBits {
+		return nil
+	}
+
+	byShard := make(map[int][]int)
+	for _, k := range keys {
+		shard, bits := f.positions(k)
+		byShard[shard] = append(byShard[shard], bits...)
+	}
+	for shard, bits := range byShard {
+		err := f.setBits(c, shard, bits)
+		if err == nil {
+			continue
+		}
+		delErr := memcache.Delete(c, f.shardKey(shard))
+		if delErr != nil && delErr != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
+
+// setBits sets bits in a shard, creating the shard if it's missing
+func (f *BloomFilter) setBits(c context.Context, shard int, bits []int) error {
+	key := f.shardKey(shard)
+	for attempt := 0; attempt < filterCASAttempts; attempt++ {
+		item, err := memcache.Get(c, key)
+		if err == memcache.ErrCacheMiss {
+			item = &memcache.Item{Key: key, Value: f.newShard()}
+			setFilterBits(item.Value, bits)
+			err = memcache.Add(c, item)
+			if err == memcache.ErrNotStored {
+				continue // someone else created it
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if !f.validShard(item.Value) {
+			return errBadFilter
+		}
+
+		if !setFilterBits(item.Value, bits) {
+			return nil // already there
+		}
+		err = memcache.CompareAndSwap(c, item)
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			continue
+		}
+		return err
+	}
+	return errFilterContention
+}
+
+// setFilterBits sets bits in a shard's value.  Returns false if they were all
+// set already.
+func setFilterBits(value []byte, bits []int) bool {
+	changed := false
+	body := value[filterHeader:]
+	for _, b := range bits {
+		mask := byte(1) << uint(b%8)
+		if body[b/8]&mask == 0 {
+			body[b/8] |= mask
+			changed = true
+		}
+	}
+	return changed
+}
+
+// filterAbsent returns those keys which the filter says definitely don't
+// exist.  Keys whose shards are missing or incomplete might exist.
+func filterAbsent(c context.Context, keys []string) map[string]bool {
+	f := Filter
+	if f == nil || len(keys) == 0 || f.bits() > MaxFilterBits {
+		return nil
+	}
+
+	shardKeys := make([]string, 0, len(keys))
+	seen := make(map[int]bool)
+	for _, k := range keys {
+		shard, _ := f.positions(k)
+		if !seen[shard] {
+			seen[shard] = true
+			shardKeys = append(shardKeys, f.shardKey(shard))
+		}
+	}
+	items, err := memcache.GetMulti(c, shardKeys)
+	_ = err // missing shards simply can't rule anything out
+
+	absent := make(map[string]bool)
+	for _, k := range keys {
+		shard, bits := f.positions(k)
+		item, ok := items[f.shardKey(shard)]
+		if !ok || !f.validShard(item.Value) || item.Value[0]&filterComplete == 0 {
+			continue
+		}
+		body := item.Value[filterHeader:]
+		for _, b := range bits {
+			if body[b/8]&(byte(1)<<uint(b%8)) == 0 {
+				absent[k] = true
+				break
+			}
+		}
+	}
+	return absent
+}
+
+// RebuildFilter scans every KV's key into the filter and marks shards
+// complete, so FindMulti can start trusting them.  Shards evicted from
+// memcache are recreated incomplete by the next write, so run RebuildFilter
+// regularly, for example from cron.  A shard created by one run is only
+// marked complete by a later one.  It reads every key of the kind, so give it
+// plenty of time.  If c's deadline passes, nothing is marked complete.
+func RebuildFilter(c context.Context) error {
+	f := Filter
+	if f == nil {
+		return errors.New("kvs: RebuildFilter needs Filter")
+	}
+	if f.bits() > MaxFilterBits {
+		return fmt.Errorf("kvs: BloomFilter.Bits may not exceed %d, got %d", MaxFilterBits, f.bits())
+	}
+
+	// make sure every shard exists, so writes during the scan are recorded
+	for shard := 0; shard < f.shards(); shard++ {
+		item := &memcache.Item{Key: f.shardKey(shard), Value: f.newShard()}
+		err := memcache.Add(c, item)
+		if err != nil && err != memcache.ErrNotStored {
+			return err
+		}
+	}
+	started := time.Now()
+
+	// scan all keys
+	shards := make([][]byte, f.shards())
+	for i := range shards {
+		shards[i] = f.newShard()
+	}
+	q := datastore.NewQuery(Kind).KeysOnly().Limit(MaxBatchSize)
+	for {
+		err := c.Err()
+		if err != nil {
+			return err
+		}
+		keys, cursor, err := getAllKeys(c, q)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			shard, bits := f.positions(key.StringID())
+			setFilterBits(shards[shard], bits)
+		}
+		if len(keys) < MaxBatchSize {
+			break
+		}
+		q = q.Start(cursor)
+	}
+
+	// merge into memcache
+	for shard, scanned := range shards {
+		err := f.mergeShard(c, shard, scanned, started)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeShard adds the bits of a scanned shard to the one in memcache.  It's
+// marked complete if it existed long enough before the scan started.
+func (f *BloomFilter) mergeShard(c context.Context, shard int, scanned []byte, started time.Time) error {
+	key := f.shardKey(shard)
+	for attempt := 0; attempt < filterCASAttempts; attempt++ {
+		item, err := memcache.Get(c, key)
+		if err == memcache.ErrCacheMiss {
+			return nil // evicted.  writes since then weren't recorded
+		}
+		if err != nil {
+			return err
+		}
+		if !f.validShard(item.Value) {
+			return errBadFilter
+		}
+
+		created := time.Unix(0, int64(binary.BigEndian.Uint64(item.Value[1:filterHeader])))
+		if !created.After(started.Add(-filterSettle)) {
+			item.Value[0] |= filterComplete
+		}
+		body := item.Value[filterHeader:]
+		for i, b := range scanned[filterHeader:] {
+			body[i] |= b
+		}
+		err = memcache.CompareAndSwap(c, item)
+		if err == memcache.ErrCASConflict {
+			continue
+		}
+		if err == memcache.ErrNotStored {
+			return nil // evicted
+		}
+		return err
+	}
+	return errFilterContention
+}
+
+// Note_bloom
+//
+// A Bloom filter can say a key is definitely absent, which is only true if
+// every write of that key set its bits.  Writes set them in memcache before
+// writing the datastore, so a reader never sees the KV before its bits.
+// Memcache can evict a shard at any time, though, and the writes that
+// follow only record their own keys.  So each shard carries a complete flag
+// and FindMulti only skips the datastore for keys in complete shards.
+//
+// Only RebuildFilter marks a shard complete.  It first makes sure the shard
+// exists, so every later write updates it, then scans all keys to cover the
+// earlier writes.  Because queries are eventually consistent, a shard is
+// only marked complete if it existed for filterSettle before the scan began.
+// A shard recreated after an eviction stays incomplete until the next
+// rebuild.  Deletes leave bits in place, since other keys may share them.
+// That only costs a datastore read.
+//
+// Instances with other settings, or without a filter at all, don't update
+// these shards, which is why RebuildFilter has to wait until every instance
+// agrees.  A write which can neither update its shard nor remove it fails,
+// since the filter would otherwise deny that the key exists.
@@ -0,0 +1,88 @@
+package kvs
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Loader fetches the value for a key from some slow data source.
+type Loader func(c context.Context, k string) ([]byte, error)
+
+// Cache is a read-through cache in front of an arbitrary data source.  Values
+// are stored as ordinary KVs, so they're shared by all instances and survive
+// memcache evictions.  A Cache must not be copied after first use.
+type Cache struct {
+	// Loader fetches values which aren't in the cache yet.
+	Loader Loader
+
+	// Ttl describes how long a loaded value stays in the cache.  Zero means
+	// until it's invalidated.
+	Ttl time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*loadCall
+}
+
+// loadCall is a Loader call which is either in progress or completed
+type loadCall struct {
+	wg    sync.WaitGroup
+	value []byte
+	err   error
+}
+
+// Get returns the value for key k.  If it's not cached, Get calls Loader and
+// caches the result.  Concurrent calls to Get for the same key, within this
+// instance, share a single Loader call.
+//
+// Loader errors are returned as is and nothing is cached.
+func (cache *Cache) Get(c context.Context, k string) ([]byte, error) {
+	kv, err := Find(c, k)
+	if err == nil {
+		return kv.Value, nil
+	}
+	if !IsNotFound(err) {
+		return nil, err
+	}
+
+	return cache.load(c, k)
+}
+
+// Invalidate removes the cached value for key k, if any.  The next Get for
+// that key calls Loader again.
+func (cache *Cache) Invalidate(c context.Context, k string) error {
+	kv := &KV{Key: k}
+	return kv.Delete(c)
+}
+
+// load calls Loader unless another goroutine is already doing so
+func (cache *Cache) load(c context.Context, k string) ([]byte, error) {
+	cache.mu.Lock()
+	if call, ok := cache.calls[k]; ok {
+		cache.mu.Unlock()
+		call.wg.Wait()
+		return call.value, call.err
+	}
+	if cache.calls == nil {
+		cache.calls = make(map[string]*loadCall)
+	}
+	call := new(loadCall)
+	call.wg.Add(1)
+	cache.calls[k] = call
+	cache.mu.Unlock()
+
+	call.value, call.err = cache.Loader(c, k)
+	if call.err == nil {
+		kv := &KV{Key: k, Value: call.value, Ttl: cache.Ttl}
+		err := kv.Put(c)
+		_ = err // we have the value. caching it is an optimization
+	}
+	call.wg.Done()
+
+	cache.mu.Lock()
+	delete(cache.calls, k)
+	cache.mu.Unlock()
+
+	return call.value, call.err
+}
@@ -0,0 +1,161 @@
+package kvs
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/jjhendricks/aeds"
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// CASOp describes the change CompareAndSwapMulti makes to one key.
+type CASOp struct {
+	Key string
+	Old []byte        // expected current value.  nil means the key doesn't exist
+	New []byte        // value stored if every Old matches
+	Ttl time.Duration // how long New lives.  Zero means forever
+}
+
+// MaxCASOps is the largest number of keys CompareAndSwapMulti accepts.  Each
+// KV is its own entity group and a cross-group transaction may touch at most
+// 25 of them.
+const MaxCASOps = 25
+
+// CompareAndSwapMulti stores each op's New value, but only if every key's
+// current value equals its op's Old value.  A key which doesn't exist or has
+// expired matches a nil Old.  The comparison and the writes happen in a
+// single cross-group transaction, so either every key is changed or none
+// is.  Returns false, without changing anything, if any key didn't match.
+//
+// Memcache is updated for every key after the transaction commits.
+func CompareAndSwapMulti(c context.Context, ops []CASOp) (bool, error) {
+	if aeds.IsReadOnly() {
+		return false, aeds.ErrReadOnly
+	}
+	if len(ops) == 0 {
+		return true, nil
+	}
+	if len(ops) > MaxCASOps {
+		return false, fmt.Errorf("kvs: CompareAndSwapMulti accepts at most %d keys, got %d", MaxCASOps, len(ops))
+	}
+
+	// prepare new values before the transaction, since they don't depend on it
+	keys := make([]*datastore.Key, len(ops))
+	stored := make([]*KV, 0, len(ops))
+	items := make([]*memcache.Item, len(ops))
+	seen := make(map[string]bool, len(ops))
+	release := func() {
+		for _, kv := range stored {
+			replaceBlob(c, kv.Value, nil)
+		}
+	}
+	for i, op := range ops {
+		if seen[op.Key] {
+			release()
+			return false, fmt.Errorf("kvs: CompareAndSwapMulti got key %q twice", op.Key)
+		}
+		seen[op.Key] = true
+		keys[i] = datastore.NewKey(c, Kind, op.Key, 0, nil)
+
+		kv := &KV{Key: op.Key, Value: op.New, Ttl: op.Ttl}
+		err := kv.checkExpiration()
+		if err != nil {
+			release()
+			return false, err
+		}
+		items[i] = kv.memcacheItem()
+		value, err := sealValue(op.Key, op.New)
+		if err != nil {
+			release()
+			return false, err
+		}
+		value, err = storeValue(c, op.Key, value)
+		if err != nil {
+			release()
+			return false, err
+		}
+		kv.Value = value
+		items[i].Value = value
+		stored = append(stored, kv)
+	}
+
+	names := make([]string, len(ops))
+	for i, op := range ops {
+		names[i] = op.Key
+	}
+	err := filterAdd(c, names...)
+	if err != nil {
+		release()
+		return false, err
+	}
+
+	swapped := false
+	var old [][]byte // stored values before the transaction
+	opts := &datastore.TransactionOptions{XG: true}
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		swapped = false
+		current := make([]KV, len(keys))
+		err := datastore.GetMulti(c, keys, current)
+		merr, _ := err.(appengine.MultiError)
+		if err != nil && merr == nil {
+			return err
+		}
+
+		old = make([][]byte, len(keys))
+		for i, op := range ops {
+			exists := true
+			if merr != nil && merr[i] == datastore.ErrNoSuchEntity {
+				exists = false
+			} else if merr != nil && merr[i] != nil {
+				return merr[i]
+			}
+			if exists {
+				old[i] = current[i].Value
+			}
+			if exists && current[i].isExpired() {
+				exists = false
+			}
+
+			if !exists {
+				if op.Old != nil {
+					return nil // expected a value
+				}
+				continue
+			}
+			if op.Old == nil {
+				return nil // expected no value
+			}
+			value, err := loadValue(c, current[i].Value)
+			if err != nil {
+				return err
+			}
+			value, err = openValue(op.Key, value)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(value, op.Old) {
+				return nil
+			}
+		}
+
+		_, err = datastore.PutMulti(c, keys, stored)
+		swapped = err == nil
+		return err
+	}, opts)
+	if err != nil || !swapped {
+		release()
+		return false, err
+	}
+	for i := range old {
+		replaceBlob(c, old[i], stored[i].Value)
+	}
+
+	err = memcache.SetMulti(c, items)
+	_ = err // memcache is an optimization. ignore errors
+	return true, nil
+}
@@ -0,0 +1,115 @@
+package kvs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+var DecryptFailed = errors.New("Key-value pair could not be decrypted")
+
+// Encryption enables transparent encryption of values in both datastore and
+// memcache.  Put encrypts values and Find decrypts them, so callers only ever
+// see plaintext.  nil, the default, stores values as given.
+//
+// Set it once during initialization.
+var Encryption *Encrypter
+
+// Encrypter describes the keys used to encrypt values with AES-GCM.
+type Encrypter struct {
+	// Version identifies the key used to encrypt new values.  Each encrypted
+	// value records the version of its key, so older values can still be
+	// decrypted after Version changes.
+	Version byte
+
+	// Key returns the AES key (16, 24 or 32 bytes long) for a version.  To
+	// rotate keys, add a new version and change Version to match.  Keep
+	// returning old keys until all values encrypted with them have expired or
+	// been rewritten.
+	Key func(version byte) ([]byte, error)
+}
+
+// marks the start of an encrypted value.  See Note_encrypted
+var encryptedMarker = []byte("\x00kvs:aes-gcm\x00")
+
+// sealValue encrypts a value for storage under key k, if encryption is enabled
+func sealValue(k string, value []byte) ([]byte, error) {
+	if Encryption == nil {
+		return value, nil
+	}
+
+	gcm, err := Encryption.gcm(Encryption.Version)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 0, len(encryptedMarker)+1+len(nonce)+len(value)+gcm.Overhead())
+	sealed = append(sealed, encryptedMarker...)
+	sealed = append(sealed, Encryption.Version)
+	sealed = append(sealed, nonce...)
+	return gcm.Seal(sealed, nonce, value, []byte(k)), nil
+}
+
+// openValue decrypts a value stored under key k, if it's encrypted.  Returns
+// DecryptFailed if the value can't be decrypted with the available keys.
+func openValue(k string, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, encryptedMarker) {
+		return value, nil // stored before encryption was enabled
+	}
+	if Encryption == nil {
+		return nil, DecryptFailed
+	}
+
+	rest := value[len(encryptedMarker):]
+	if len(rest) < 1 {
+		return nil, DecryptFailed
+	}
+	gcm, err := Encryption.gcm(rest[0])
+	if err != nil {
+		return nil, err
+	}
+	rest = rest[1:]
+	if len(rest) < gcm.NonceSize() {
+		return nil, DecryptFailed
+	}
+
+	nonce, ciphertext := rest[:gcm.NonceSize()], rest[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(k))
+	if err != nil {
+		return nil, DecryptFailed
+	}
+	return plaintext, nil
+}
+
+// gcm returns an AEAD for the given key version
+func (enc *Encrypter) gcm(version byte) (cipher.AEAD, error) {
+	key, err := enc.Key(version)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Note_encrypted
+//
+// An encrypted value is the marker, one byte of key version, a random nonce
+// and finally the ciphertext.  The KV's key is used as additional data, so a
+// ciphertext copied from one key to another fails to decrypt instead of
+// silently producing the wrong value.
+//
+// Values without the marker are returned unchanged.  That lets encryption be
+// enabled on a store which already holds plaintext values.  A plaintext value
+// which happens to begin with the marker is indistinguishable from an
+// encrypted one, so the marker is long and unlikely to occur by accident.
@@ -0,0 +1,187 @@
+package kvs
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jjhendricks/aeds"
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// EventLog stores append-only streams of small events.  Each event is an
+// ordinary KV keyed "log:stream:seq", where seq counts up from 1 and is zero
+// padded so that keys sort in order.  Another KV, keyed "log:stream", holds
+// the last sequence number of each stream.
+//
+// Append updates that counter and stores the event in one cross-group
+// transaction, so concurrent appends never share a sequence number.  It also
+// means a single stream accepts only about one append per second.  Events
+// aren't offloaded to Blobs, so each one must fit in a datastore entity.
+type EventLog struct {
+	// Ttl describes how long each event is kept.  Zero means forever.
+	// Expired events are skipped by ReadRange and removed by
+	// CollectGarbage, but they keep their sequence numbers.
+	Ttl time.Duration
+}
+
+// Event is one entry in an EventLog stream.
+type Event struct {
+	Seq  int64
+	Data []byte
+}
+
+// Append adds an event to the end of a stream and returns its sequence
+// number.
+func (l EventLog) Append(c context.Context, stream string, data []byte) (int64, error) {
+	if aeds.IsReadOnly() {
+		return 0, aeds.ErrReadOnly
+	}
+
+	ck := eventCounterKey(stream)
+	counterKey := datastore.NewKey(c, Kind, ck, 0, nil)
+	var seq int64
+	var item *memcache.Item
+	opts := &datastore.TransactionOptions{XG: true}
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		last, err := lastEventSeq(c, counterKey)
+		if err != nil {
+			return err
+		}
+		seq = last + 1
+
+		counter := &KV{Key: ck}
+		counter.Value, err = sealValue(ck, []byte(strconv.FormatInt(seq, 10)))
+		if err != nil {
+			return err
+		}
+
+		ek := eventKey(stream, seq)
+		event := &KV{Key: ek, Value: data, Ttl: l.Ttl}
+		item = event.memcacheItem()
+		event.Value, err = sealValue(ek, data)
+		if err != nil {
+			return err
+		}
+		item.Value = event.Value
+
+		err = filterAdd(c, ck, ek)
+		if err != nil {
+			return err
+		}
+		keys := []*datastore.Key{counterKey, event.datastoreKey(c)}
+		_, err = datastore.PutMulti(c, keys, []*KV{counter, event})
+		return err
+	}, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	err = memcache.Set(c, item)
+	_ = err // memcache is an optimization. ignore errors
+	return seq, nil
+}
+
+// ReadRange returns the events of a stream with sequence numbers from
+// through to, inclusive, in order.  Events which have expired are skipped.
+// Reads are strongly consistent, so every event appended before ReadRange
+// starts is included.
+func (l EventLog) ReadRange(c context.Context, stream string, from, to int64) ([]Event, error) {
+	last, err := lastEventSeq(c, datastore.NewKey(c, Kind, eventCounterKey(stream), 0, nil))
+	if err != nil {
+		return nil, err
+	}
+	if from < 1 {
+		from = 1
+	}
+	if to > last {
+		to = last
+	}
+
+	var events []Event
+	for start := from; start <= to; start += MaxBatchSize {
+		end := start + MaxBatchSize - 1
+		if end > to {
+			end = to
+		}
+		batch, err := readEvents(c, stream, start, end)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, batch...)
+	}
+	return events, nil
+}
+
+// readEvents does the work of ReadRange for at most MaxBatchSize events
+func readEvents(c context.Context, stream string, from, to int64) ([]Event, error) {
+	n := int(to - from + 1)
+	keys := make([]*datastore.Key, n)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, Kind, eventKey(stream, from+int64(i)), 0, nil)
+	}
+	kvs := make([]KV, n)
+	err := datastore.GetMulti(c, keys, kvs)
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
+		return nil, err
+	}
+
+	events := make([]Event, 0, n)
+	for i := range kvs {
+		if merr != nil && merr[i] == datastore.ErrNoSuchEntity {
+			continue // collected after expiring
+		}
+		if merr != nil && merr[i] != nil {
+			return nil, merr[i]
+		}
+		kv := &kvs[i]
+		if kv.isExpired() {
+			continue
+		}
+
+		value, err := loadValue(c, kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		value, err = openValue(kv.Key, value)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, Event{Seq: from + int64(i), Data: value})
+	}
+	return events, nil
+}
+
+// lastEventSeq returns the last sequence number recorded in a stream's
+// counter, or zero if the stream is empty
+func lastEventSeq(c context.Context, counterKey *datastore.Key) (int64, error) {
+	var counter KV
+	err := datastore.Get(c, counterKey, &counter)
+	if err == datastore.ErrNoSuchEntity {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := openValue(counter.Key, counter.Value)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(value), 10, 64)
+}
+
+// eventCounterKey returns the KV key holding a stream's last sequence number
+func eventCounterKey(stream string) string {
+	return "log:" + stream
+}
+
+// eventKey returns the KV key of one event in a stream
+func eventKey(stream string, seq int64) string {
+	return fmt.Sprintf("log:%s:%020d", stream, seq)
+}
@@ -0,0 +1,30 @@
+package kvs
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// gcSettings holds the settings registered with RegisterGC, by kind
+var gcSettings = make(map[string]GC)
+
+// RegisterGC associates garbage collection settings with a kind of KV
+// entities, for use by CollectGarbageFor.  Call it during init.  Registering
+// a kind again replaces its settings.
+func RegisterGC(kind string, opts GC) {
+	gcSettings[kind] = opts
+}
+
+// CollectGarbageFor is like CollectGarbage for the KVs stored in the given
+// kind, using the settings registered for it with RegisterGC.  That lets every
+// cron handler look the same.  It's an error if the kind has no settings.
+func CollectGarbageFor(c context.Context, kind string) (int, error) {
+	opts, ok := gcSettings[kind]
+	if !ok {
+		return 0, fmt.Errorf("kvs: no GC settings registered for kind %q", kind)
+	}
+
+	stats, err := collectGarbageStats(c, kind, &opts)
+	return stats.Deleted, err
+}
@@ -0,0 +1,96 @@
+package kvs
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// errUnchanged aborts a Modify which has nothing to write
+var errUnchanged = errors.New("kvs: value unchanged")
+
+// A hash stores several named fields under a single key, similar to a Redis
+// hash.  The fields are kept as a gob-encoded map[string][]byte in one KV so
+// the whole hash shares one expiration.
+//
+// HSet and HDel are datastore transactions on the entire hash, so concurrent
+// changes to different fields of the same hash never lose each other's
+// updates.  They do contend with each other, though, so a single hash
+// shouldn't be written more than about once per second.  Memcache is updated
+// after each transaction commits.  Like any other KV written with Modify, a
+// read shortly after concurrent writes might briefly see an older version of
+// the hash.
+
+// HSet stores value in field of the hash at key k.  If ttl is positive, the
+// whole hash expires after ttl.  Otherwise, the hash's existing expiration is
+// unchanged.
+func HSet(c context.Context, k, field string, value []byte, ttl time.Duration) error {
+	return Modify(c, k, func(kv *KV, ok bool) error {
+		fields, err := kv.hashFields(ok)
+		if err != nil {
+			return err
+		}
+
+		fields[field] = value
+		if ttl > 0 {
+			kv.Ttl = ttl
+		}
+		return kv.Encode(fields)
+	})
+}
+
+// HGet returns the value of field in the hash at key k.  Returns a
+// *NotFoundError if either the hash or the field doesn't exist.
+func HGet(c context.Context, k, field string) ([]byte, error) {
+	kv, err := Find(c, k)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := kv.hashFields(true)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := fields[field]
+	if !ok {
+		return nil, &NotFoundError{Key: k}
+	}
+	return value, nil
+}
+
+// HDel removes field from the hash at key k.  It's not an error if the field
+// doesn't exist.
+func HDel(c context.Context, k, field string) error {
+	err := Modify(c, k, func(kv *KV, ok bool) error {
+		fields, err := kv.hashFields(ok)
+		if err != nil {
+			return err
+		}
+		if _, present := fields[field]; !present {
+			return errUnchanged
+		}
+
+		delete(fields, field)
+		return kv.Encode(fields)
+	})
+	if err == errUnchanged {
+		return nil
+	}
+	return err
+}
+
+// hashFields decodes a KV's value as a hash.  If the KV doesn't exist (ok is
+// false), the hash is empty.
+func (kv *KV) hashFields(ok bool) (map[string][]byte, error) {
+	fields := make(map[string][]byte)
+	if !ok || len(kv.Value) == 0 {
+		return fields, nil
+	}
+
+	err := kv.Decode(&fields)
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
@@ -0,0 +1,139 @@
+package kvs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jjhendricks/aeds"
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// History entities are children of the KV they belong to, so a KV and its
+// history share an entity group.  That lets PutWithHistory update both in one
+// transaction and lets History use a strongly consistent ancestor query.
+// Each one is keyed by "key@nanoseconds" so that key order is time order.
+
+// historyKind returns the datastore kind for previous values of KVs
+func historyKind() string {
+	return Kind + "-history"
+}
+
+// PutWithHistory is like Put but first saves the existing value, if any, in
+// the KV's history.  Only the keep most recent previous values are retained
+// (all of them if keep isn't positive).  The save, the trim and the write
+// happen in one transaction.
+//
+// History is kept in its own kind, so it isn't removed by Delete or by
+// CollectGarbage.
+func (kv *KV) PutWithHistory(c context.Context, keep int) error {
+	if aeds.IsReadOnly() {
+		return aeds.ErrReadOnly
+	}
+	err := kv.checkExpiration()
+	if err != nil {
+		return err
+	}
+	err = filterAdd(c, kv.Key)
+	if err != nil {
+		return err
+	}
+
+	item := kv.memcacheItem()
+	stored := *kv
+	stored.Value, err = sealValue(kv.Key, kv.Value)
+	if err != nil {
+		return err
+	}
+	stored.Value, err = storeValue(c, kv.Key, stored.Value)
+	if err != nil {
+		return err
+	}
+	item.Value = stored.Value
+
+	key := kv.datastoreKey(c)
+	var trimmed []KV
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		trimmed = nil
+		var old KV
+		err := datastore.Get(c, key, &old)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil {
+			// values are stored sealed, so they can be copied as they are
+			name := fmt.Sprintf("%s@%020d", kv.Key, time.Now().UnixNano())
+			_, err = datastore.Put(c, datastore.NewKey(c, historyKind(), name, 0, key), &old)
+			if err != nil {
+				return err
+			}
+
+			if keep > 0 {
+				var entries []KV
+				keys, err := datastore.NewQuery(historyKind()).
+					Ancestor(key).
+					GetAll(c, &entries)
+				if err != nil {
+					return err
+				}
+				// the query doesn't see the entry we just added
+				if n := len(keys) + 1 - keep; n > 0 {
+					err = datastore.DeleteMulti(c, keys[:n])
+					if err != nil {
+						return err
+					}
+					trimmed = entries[:n]
+				}
+			}
+		}
+
+		_, err = datastore.Put(c, key, &stored)
+		return err
+	}, nil)
+	if err != nil {
+		replaceBlob(c, stored.Value, nil)
+		return err
+	}
+	for _, old := range trimmed {
+		replaceBlob(c, old.Value, nil)
+	}
+
+	err = memcache.Set(c, item)
+	_ = err // memcache is an optimization. ignore errors
+	return nil
+}
+
+// History returns previous values of the KV at key k, saved by
+// PutWithHistory, newest first.  At most n values are returned (all of them
+// if n isn't positive).  The ancestor query is strongly consistent unless c
+// comes from aeds.WithEventualConsistency.
+func History(c context.Context, k string, n int) ([]*KV, error) {
+	var kvs []*KV
+	q := datastore.NewQuery(historyKind()).
+		Ancestor(datastore.NewKey(c, Kind, k, 0, nil))
+	_, err := aeds.QueryConsistency(c, q).GetAll(c, &kvs)
+	if err != nil {
+		return nil, err
+	}
+
+	// oldest first, so reverse them
+	for i, j := 0, len(kvs)-1; i < j; i, j = i+1, j-1 {
+		kvs[i], kvs[j] = kvs[j], kvs[i]
+	}
+	if n > 0 && len(kvs) > n {
+		kvs = kvs[:n]
+	}
+	for _, kv := range kvs {
+		kv.Value, err = loadValue(c, kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		kv.Value, err = openValue(k, kv.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return kvs, nil
+}
@@ -7,18 +7,50 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/jjhendricks/aeds"
 	"golang.org/x/net/context"
 
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/memcache"
 )
 
-const kind = "kvs"
+// Kind is the datastore kind used for KVs.  It also prefixes memcache keys,
+// so KVs of different kinds never share cache entries.  Services in the same
+// project which need separate key-value namespaces can each set their own
+// Kind during initialization.  Changing it later abandons every existing KV.
+var Kind = "kvs"
 
 var NotFound = fmt.Errorf("Key-value pair was not found")
 
+// NotFoundError is returned by Find and friends when a key doesn't exist.
+// Use IsNotFound to check for it.  With errors.Is, it also matches NotFound.
+type NotFoundError struct {
+	Key string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("Key-value pair %q was not found", e.Key)
+}
+
+// Is reports whether target is NotFound, for the benefit of errors.Is.
+func (e *NotFoundError) Is(target error) bool {
+	return target == NotFound
+}
+
+// IsNotFound returns true if err indicates that a key doesn't exist.  It
+// recognizes both NotFound and *NotFoundError.
+func IsNotFound(err error) bool {
+	if err == NotFound {
+		return true
+	}
+	_, ok := err.(*NotFoundError)
+	return ok
+}
+
 // use App Engine's datastore as a simple key-value store
 
 type KV struct {
@@ -26,7 +58,34 @@ type KV struct {
 	Value   []byte `datastore:",noindex"`
 	Expires time.Time
 
-	Ttl time.Duration `datastore:"-"` // convenient alternative to Expires
+	// Pinned protects a KV from CollectGarbage, even after it expires.  See
+	// Note_pinned
+	Pinned bool `datastore:",noindex"`
+
+	// Ttl is a convenient alternative to Expires.  If it's positive, it
+	// wins: writes replace Expires with the current time plus Ttl, then
+	// reset Ttl to zero.  See StrictExpiration
+	Ttl time.Duration `datastore:"-"`
+}
+
+// StrictExpiration makes Put, PutWithHistory, PutLater, Modify and
+// CompareAndSwapMulti return ConflictingExpiration for a KV with both a
+// positive Ttl and a non-zero Expires, instead of quietly letting Ttl win.
+// That catches a Ttl left over from reusing a KV.  A KV returned by Find, or
+// given to Modify's callback, may have Expires set, so clear it before
+// setting Ttl.
+//
+// Defaults to false.
+var StrictExpiration bool
+
+var ConflictingExpiration = errors.New("Key-value pair has both Ttl and Expires")
+
+// checkExpiration enforces StrictExpiration
+func (kv *KV) checkExpiration() error {
+	if StrictExpiration && kv.Ttl > 0 && !kv.Expires.IsZero() {
+		return ConflictingExpiration
+	}
+	return nil
 }
 
 // GC defines options for how to perform garbage collection on KV entities.
@@ -47,46 +106,101 @@ type GC struct {
 	//
 	// Defaults to 24 hours.
 	Leeway time.Duration
+
+	// BatchSize is the number of expired KVs fetched by each query and removed
+	// by each DeleteMulti call.  Larger batches give more throughput but hold
+	// more entities in contention at once.  It may not exceed MaxBatchSize.
+	//
+	// Defaults to 400.
+	BatchSize int
+
+	// Shards is the number of goroutines which collect garbage concurrently.
+	// Expired KVs are divided among them by expiration time, so each
+	// goroutine covers a disjoint range.  All goroutines share the same Ttl.
+	// Several shards can clear a large backlog much faster than one.
+	//
+	// Defaults to 1.
+	Shards int
+
+	// CountBacklog requests that CollectGarbageStats count how many KVs are
+	// eligible for collection before it starts.  Counting costs an extra
+	// query, which can be slow when the backlog is large.
+	CountBacklog bool
+
+	// MaxBatches limits the number of query and delete round trips.  When
+	// it's reached, CollectGarbage returns CollectGarbageBudgetReached.  With
+	// several shards, the limit applies to all of them together.
+	//
+	// Defaults to 0, which means no limit.
+	MaxBatches int
 }
 
-// Find looks for an existing key-value pair.  Returns
-// NotFound if the key does not exist.
+// MaxBatchSize is the largest number of entities datastore allows in a
+// single DeleteMulti call.
+const MaxBatchSize = 500
+
+// Find looks for an existing key-value pair.  Returns a
+// *NotFoundError if the key does not exist.  See IsNotFound
+//
+// Values in memcache are ignored once they're older than MaxAge.  With a
+// context from aeds.WithCacheBypass, memcache isn't used at all.
 func Find(c context.Context, k string) (*KV, error) {
 	// is the kv in memcache?
 	kv := new(KV)
 	memcacheKey := memKey(k)
-	item, err := memcache.Get(c, memcacheKey)
-	if err == nil {
+	bypass := aeds.BypassesCache(c)
+	var item *memcache.Item
+	err := memcache.ErrCacheMiss
+	if !bypass {
+		item, err = memcache.Get(c, memcacheKey)
+	}
+	if err == nil && !tooOld(item) {
 		kv.Key = k
-		kv.Value = item.Value
+		kv.Value, err = loadValue(c, item.Value)
+		if err != nil {
+			return nil, err
+		}
+		kv.Value, err = openValue(k, kv.Value)
+		if err != nil {
+			return nil, err
+		}
 		return kv, nil
 	}
 
 	// nope, look in the datastore
-	key := datastore.NewKey(c, kind, k, 0, nil)
+	key := datastore.NewKey(c, Kind, k, 0, nil)
 	err = datastore.Get(c, key, kv)
 	if err == datastore.ErrNoSuchEntity {
-		return nil, NotFound
+		return nil, &NotFoundError{Key: k}
 	}
 	if err != nil {
 		return nil, err
 	}
 	if kv.isExpired() {
 		// key has expired. pretend it doesn't exist
-		return nil, NotFound
+		return nil, &NotFoundError{Key: k}
 	}
 
 	// store result in memcache for later
-	item = &memcache.Item{
-		Key:   memcacheKey,
-		Value: kv.Value,
-	}
-	if !kv.Expires.IsZero() {
-		item.Expiration = kv.Expires.Sub(time.Now())
+	if !bypass {
+		item = &memcache.Item{
+			Key:   memcacheKey,
+			Value: kv.Value,
+		}
+		stampItem(item)
+		item.Expiration = memcacheExpiration(kv.Expires, time.Now())
+		err = memcache.Set(c, item)
+		_ = err // memcache is an optimization. ignore its errors.
 	}
-	err = memcache.Set(c, item)
-	_ = err // memcache is an optimization. ignore its errors.
 
+	kv.Value, err = loadValue(c, kv.Value)
+	if err != nil {
+		return nil, err
+	}
+	kv.Value, err = openValue(k, kv.Value)
+	if err != nil {
+		return nil, err
+	}
 	return kv, nil
 }
 
@@ -95,7 +209,7 @@ func (kv *KV) isExpired() bool {
 }
 
 func (kv *KV) datastoreKey(c context.Context) *datastore.Key {
-	return datastore.NewKey(c, kind, kv.Key, 0, nil)
+	return datastore.NewKey(c, Kind, kv.Key, 0, nil)
 }
 
 // build a memcache item and standardize kv.Expiration
@@ -106,28 +220,81 @@ func (kv *KV) memcacheItem() *memcache.Item {
 		Key:   memcacheKey,
 		Value: kv.Value,
 	}
+	stampItem(item)
 
 	// calculate key-value expiration time
+	now := time.Now()
 	if kv.Ttl > 0 {
-		item.Expiration = kv.Ttl
-		kv.Expires = time.Now().Add(kv.Ttl)
+		kv.Expires = now.Add(kv.Ttl)
 		kv.Ttl = 0
-	} else if !kv.Expires.IsZero() {
-		item.Expiration = kv.Expires.Sub(time.Now())
 	}
+	item.Expiration = memcacheExpiration(kv.Expires, now)
 
 	return item
 }
 
+// memcacheExpiration converts a KV's expiration time into a memcache item's
+// Expiration, measured from now.  Zero means the KV never expires.  See
+// Note_expiration
+func memcacheExpiration(expires, now time.Time) time.Duration {
+	if expires.IsZero() {
+		return 0
+	}
+	d := expires.Sub(now).Truncate(time.Second)
+	if d < time.Second {
+		return time.Second // zero would mean forever
+	}
+	return d
+}
+
+// Note_expiration
+//
+// Memcache only takes an item's lifetime relative to when it's stored, and
+// ignores fractions of a second.  The lifetime is derived from the same
+// Expires which goes to the datastore, using a single reading of the clock,
+// and rounded down to whole seconds.  A slow request might still store the
+// item a little later, but the KV's memcache copy never outlives its
+// datastore copy by more than that delay.  A KV which has already expired
+// (or nearly) would get a zero or negative lifetime, which memcache could
+// take to mean no expiration at all.  It's given one second instead.
+
 // Put stores a key-value pair until its expiration.
 func (kv *KV) Put(c context.Context) error {
+	if aeds.IsReadOnly() {
+		return aeds.ErrReadOnly
+	}
+	err := kv.checkExpiration()
+	if err != nil {
+		return err
+	}
+	err = filterAdd(c, kv.Key)
+	if err != nil {
+		return err
+	}
+
 	item := kv.memcacheItem()
+	stored := *kv
+	stored.Value, err = sealValue(kv.Key, kv.Value)
+	if err != nil {
+		return err
+	}
+	stored.Value, err = storeValue(c, kv.Key, stored.Value)
+	if err != nil {
+		return err
+	}
+	item.Value = stored.Value
 
 	// store kv into datastore for permanent storage
-	_, err := datastore.Put(c, kv.datastoreKey(c), kv)
+	key := kv.datastoreKey(c)
+	old := storedValues(c, []*datastore.Key{key})
+	_, err = datastore.Put(c, key, &stored)
 	if err != nil {
+		replaceBlob(c, stored.Value, nil)
 		return err
 	}
+	if old != nil {
+		replaceBlob(c, old[0], stored.Value)
+	}
 
 	// cache kv for faster access next time
 	err = memcache.Set(c, item)
@@ -147,32 +314,80 @@ func (kv *KV) Put(c context.Context) error {
 // best to choose one and use it exclusively for all writes.  Find
 // works well for reads in both cases.
 func Modify(c context.Context, k string, f func(*KV, bool) error) error {
+	if aeds.IsReadOnly() {
+		return aeds.ErrReadOnly
+	}
+	err := filterAdd(c, k)
+	if err != nil {
+		return err
+	}
+
 	var kv KV
 	var item *memcache.Item
-	key := datastore.NewKey(c, kind, k, 0, nil)
-	err := datastore.RunInTransaction(c, func(c context.Context) error {
+	var old []byte       // stored value before the transaction
+	var written [][]byte // stored values written by each attempt
+	key := datastore.NewKey(c, Kind, k, 0, nil)
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		old = nil
 		err := datastore.Get(c, key, &kv)
+		if err == nil {
+			old = kv.Value
+		}
 		if err == nil && kv.isExpired() {
 			kv = KV{} // pretend there was no value
 			err = datastore.ErrNoSuchEntity
 		}
 		switch err {
 		case nil:
-			f(&kv, true)
+			kv.Value, err = loadValue(c, kv.Value)
+			if err != nil {
+				return err
+			}
+			kv.Value, err = openValue(k, kv.Value)
+			if err != nil {
+				return err
+			}
+			err = f(&kv, true)
 		case datastore.ErrNoSuchEntity:
 			kv.Key = k
-			f(&kv, false)
+			err = f(&kv, false)
 		default:
 			return err
 		}
+		if err != nil {
+			return err
+		}
+		err = kv.checkExpiration()
+		if err != nil {
+			return err
+		}
 		item = kv.memcacheItem()
 
-		_, err = datastore.Put(c, key, &kv)
+		stored := kv
+		stored.Value, err = sealValue(k, kv.Value)
+		if err != nil {
+			return err
+		}
+		stored.Value, err = storeValue(c, k, stored.Value)
+		if err != nil {
+			return err
+		}
+		written = append(written, stored.Value)
+		item.Value = stored.Value
+		_, err = datastore.Put(c, key, &stored)
 		return err
 	}, nil)
+
+	// remove objects which were replaced or never committed
+	for i, value := range written {
+		if err != nil || i < len(written)-1 {
+			replaceBlob(c, value, nil)
+		}
+	}
 	if err != nil {
 		return err
 	}
+	replaceBlob(c, old, item.Value)
 
 	// update memcache
 	err = memcache.Set(c, item)
@@ -182,18 +397,70 @@ func Modify(c context.Context, k string, f func(*KV, bool) error) error {
 
 // Remove a rule in the datastore
 func (kv *KV) Delete(c context.Context) error {
+	if aeds.IsReadOnly() {
+		return aeds.ErrReadOnly
+	}
+
 	// delete from datastore
-	err := datastore.Delete(c, kv.datastoreKey(c))
+	key := kv.datastoreKey(c)
+	old := storedValues(c, []*datastore.Key{key})
+	err := datastore.Delete(c, key)
 	if err != nil {
 		return err
 	}
+	if old != nil {
+		replaceBlob(c, old[0], nil)
+	}
 
-	// delete from memcache too
-	err = memcache.Delete(c, memKey(kv.Key))
+	// delete from memcache too, including any write waiting for PutLater
+	err = memcache.DeleteMulti(c, []string{memKey(kv.Key), pendingKey(kv.Key)})
 	_ = err // memcache is an optimization. ignore errors.
 	return nil
 }
 
+// DeleteIfExpired removes the KV with key k, but only if it has an expiration
+// which has already passed.  The check and the delete happen in one
+// transaction, so a KV refreshed by a concurrent writer is never removed.
+// Returns true if the KV was deleted.
+func DeleteIfExpired(c context.Context, k string) (bool, error) {
+	if aeds.IsReadOnly() {
+		return false, aeds.ErrReadOnly
+	}
+
+	deleted := false
+	var old []byte
+	key := datastore.NewKey(c, Kind, k, 0, nil)
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		deleted = false
+
+		var kv KV
+		err := datastore.Get(c, key, &kv)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !kv.isExpired() {
+			return nil
+		}
+
+		old = kv.Value
+		err = datastore.Delete(c, key)
+		deleted = err == nil
+		return err
+	}, nil)
+	if err != nil || !deleted {
+		return false, err
+	}
+	replaceBlob(c, old, nil)
+
+	// memcache should have expired already, but make sure
+	err = memcache.Delete(c, memKey(k))
+	_ = err // memcache is an optimization. ignore errors.
+	return true, nil
+}
+
 // Compress rewrites the Value field by compressing it with gzip.
 func (kv *KV) Compress() error {
 	var buf bytes.Buffer
@@ -245,20 +512,139 @@ func (kv *KV) Decode(x interface{}) error {
 	return gob.NewDecoder(buf).Decode(x)
 }
 
+// EncodeCompressed is like Encode followed by Compress, but gob encodes
+// straight into the compressor so there's no intermediate buffer.  level is a
+// compress/gzip level, such as gzip.BestSpeed.  Decode the result with
+// DecodeCompressed, or with Decompress and Decode.
+func (kv *KV) EncodeCompressed(x interface{}, level int) error {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(w).Encode(x)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	kv.Value = buf.Bytes()
+	return nil
+}
+
+// DecodeCompressed is like Decompress followed by Decode, but gob decodes
+// straight from the decompressor.  Unlike Decompress, it leaves the Value
+// field alone.
+func (kv *KV) DecodeCompressed(x interface{}) error {
+	r, err := gzip.NewReader(bytes.NewReader(kv.Value))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return gob.NewDecoder(r).Decode(x)
+}
+
+// ExpiringBefore returns the keys of KVs which expire before t, soonest
+// first.  KVs which never expire or are pinned aren't included.  If limit is
+// positive, at most limit keys are returned.  Since t may be in the past, the
+// result can include KVs which have already expired but haven't yet been
+// garbage collected.
+//
+// This uses the same index as CollectGarbage, so it's eventually consistent
+// like any other datastore query.
+func ExpiringBefore(c context.Context, t time.Time, limit int) ([]string, error) {
+	q := datastore.NewQuery(Kind).
+		Filter("Expires>", time.Time{}).
+		Filter("Expires<", t).
+		Order("Expires").
+		KeysOnly()
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	keys, err := aeds.QueryConsistency(c, q).GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	ks := make([]string, len(keys))
+	for i, key := range keys {
+		ks[i] = key.StringID()
+	}
+	return ks, nil
+}
+
 // returns a key for use with memcache
 func memKey(key string) string {
-	return fmt.Sprintf("%s: %s", kind, key)
+	return fmt.Sprintf("%s: %s", Kind, key)
 }
 
 var CollectGarbageTimeout = errors.New("CollectGarbage timed out")
+var CollectGarbageBudgetReached = errors.New("CollectGarbage reached GC.MaxBatches")
+var CollectGarbageRunning = errors.New("CollectGarbage is already running")
+
+// GCStats describes the work done by a single garbage collection.
+type GCStats struct {
+	// Scanned is the number of expired KVs found by queries.
+	Scanned int
+
+	// Deleted is the number of expired KVs removed from datastore.
+	Deleted int
+
+	// Batches is the number of query and delete round trips.
+	Batches int
+
+	// Elapsed is how long garbage collection ran.
+	Elapsed time.Duration
+
+	// Backlog is the number of KVs which were eligible for collection when
+	// garbage collection started.  It's -1 unless GC.CountBacklog is set.
+	Backlog int
+}
+
+// add accumulates the counts from another GCStats
+func (s *GCStats) add(other GCStats) {
+	s.Scanned += other.Scanned
+	s.Deleted += other.Deleted
+	s.Batches += other.Batches
+}
 
 // CollectGarbage deletes expired kv entities from the datastore. This function
 // should be called regularly to prevent expired kvs from accumulating in the
 // datastore.  Returns the number of entities that were removed from datastore.
+// Pinned KVs are never removed.
 //
 // If GC.Ttl is reached, returns CollectGarbageTimeout regardless how many
-// entities were expired before then.
+// entities were expired before then.  Similarly, if GC.MaxBatches is reached,
+// returns CollectGarbageBudgetReached.  If c is cancelled or its deadline
+// passes, returns the context's error.  In every case, the count reflects the
+// entities removed before stopping.
+//
+// Only one garbage collection runs at a time for each kind.  Each run holds a
+// Lock for twice GC.Ttl, so a run which crashes doesn't block later ones for
+// long.  If another run holds it, returns CollectGarbageRunning without
+// doing anything.
 func CollectGarbage(c context.Context, opts *GC) (int, error) {
+	stats, err := CollectGarbageStats(c, opts)
+	return stats.Deleted, err
+}
+
+// CollectGarbageStats is like CollectGarbage but describes its work in more
+// detail.  Comparing Deleted to Backlog over several runs shows whether
+// garbage collection is keeping up.
+func CollectGarbageStats(c context.Context, opts *GC) (GCStats, error) {
+	return collectGarbageStats(c, Kind, opts)
+}
+
+// collectGarbageStats does the work of CollectGarbageStats for KVs stored in
+// the given kind
+func collectGarbageStats(c context.Context, kind string, opts *GC) (stats GCStats, err error) {
+	stats.Backlog = -1
+	if aeds.IsReadOnly() {
+		return stats, aeds.ErrReadOnly
+	}
 	if opts == nil {
 		opts = &GC{}
 	}
@@ -268,31 +654,103 @@ func CollectGarbage(c context.Context, opts *GC) (int, error) {
 	if opts.Leeway == 0 {
 		opts.Leeway = 24 * time.Hour
 	}
-	quittingTime := time.Now().Add(opts.Ttl)
-	cutOff := time.Now().Add(-opts.Leeway)
+	if opts.BatchSize == 0 {
+		opts.BatchSize = 400
+	}
+	if opts.BatchSize < 0 || opts.BatchSize > MaxBatchSize {
+		return stats, fmt.Errorf("GC.BatchSize must be between 1 and %d, got %d", MaxBatchSize, opts.BatchSize)
+	}
+	if opts.Ttl < 0 {
+		return stats, fmt.Errorf("GC.Ttl must be positive, got %s", opts.Ttl)
+	}
+
+	// keep overlapping runs from deleting the same keys
+	lease := gcLeaseKey(kind)
+	token, acquired, err := Lock(c, lease, 2*opts.Ttl)
+	if err != nil {
+		return stats, err
+	}
+	if !acquired {
+		return stats, CollectGarbageRunning
+	}
+	defer func() {
+		unlockErr := Unlock(c, lease, token)
+		_ = unlockErr // the lease expires on its own
+	}()
+
+	started := time.Now()
+	quittingTime := started.Add(opts.Ttl)
+	cutOff := started.Add(-opts.Leeway)
+	defer func() { stats.Elapsed = time.Since(started) }()
+	var budget *int64
+	if opts.MaxBatches > 0 {
+		n := int64(opts.MaxBatches)
+		budget = &n
+	}
+
+	if opts.CountBacklog {
+		n, err := datastore.NewQuery(kind).
+			Filter("Expires<", cutOff).
+			KeysOnly().
+			Count(c)
+		if err != nil {
+			return stats, err
+		}
+		stats.Backlog = n
+	}
+
+	if opts.Shards > 1 {
+		err = collectGarbageSharded(c, kind, opts, cutOff, quittingTime, budget, &stats)
+		return stats, err
+	}
 
-	const limit = 400
-	n := 0
 	q := datastore.NewQuery(kind).
 		Filter("Expires<", cutOff).
 		Order("Expires").
-		Limit(limit).
+		Limit(opts.BatchSize).
 		KeysOnly()
+	err = collectGarbage(c, q, opts.BatchSize, quittingTime, budget, &stats)
+	return stats, err
+}
+
+// gcLeaseKey returns the key of the Lock held while collecting garbage in a
+// kind
+func gcLeaseKey(kind string) string {
+	return "gc-lease: " + kind
+}
+
+// collectGarbage deletes every entity matched by q, which should be a
+// keys-only query returning at most limit keys.  If budget isn't nil, it's
+// the number of batches remaining, shared with other goroutines.
+func collectGarbage(c context.Context, q *datastore.Query, limit int, quittingTime time.Time, budget *int64, stats *GCStats) error {
 	for {
+		err := c.Err()
+		if err != nil {
+			return err
+		}
 		if time.Now().After(quittingTime) {
-			return n, CollectGarbageTimeout
+			return CollectGarbageTimeout
+		}
+		if budget != nil && atomic.AddInt64(budget, -1) < 0 {
+			return CollectGarbageBudgetReached
 		}
 
 		keys, cursor, err := getAllKeys(c, q)
+		stats.Batches++
+		stats.Scanned += len(keys)
 		if len(keys) > 0 {
+			old := storedValues(c, keys)
 			err = datastore.DeleteMulti(c, keys)
 			// don't have to clear memcache. it expires on its own
 			if err == nil {
-				n += len(keys)
+				stats.Deleted += len(keys)
+				for _, value := range old {
+					replaceBlob(c, value, nil)
+				}
 			}
 		}
 		if err != nil {
-			return n, err
+			return err
 		}
 		if len(keys) < limit {
 			// fetched all keys in 1st batch. no need for 2nd batch
@@ -301,7 +759,65 @@ func CollectGarbage(c context.Context, opts *GC) (int, error) {
 		q = q.Start(cursor) // See Note_eventual
 	}
 
-	return n, nil
+	return nil
+}
+
+// collectGarbageSharded splits expired KVs into opts.Shards ranges of
+// expiration time and collects each range in its own goroutine
+func collectGarbageSharded(c context.Context, kind string, opts *GC, cutOff, quittingTime time.Time, budget *int64, stats *GCStats) error {
+	// find the oldest expired KV
+	var oldest []KV
+	_, err := datastore.NewQuery(kind).
+		Filter("Expires<", cutOff).
+		Order("Expires").
+		Limit(1).
+		GetAll(c, &oldest)
+	if err != nil {
+		return err
+	}
+	if len(oldest) == 0 {
+		return nil // nothing to collect
+	}
+	start := oldest[0].Expires
+	step := cutOff.Sub(start) / time.Duration(opts.Shards)
+
+	var wg sync.WaitGroup
+	shardStats := make([]GCStats, opts.Shards)
+	errs := make([]error, opts.Shards)
+	for i := 0; i < opts.Shards; i++ {
+		lo := start.Add(time.Duration(i) * step)
+		hi := lo.Add(step)
+		if i == opts.Shards-1 {
+			hi = cutOff
+		}
+		q := datastore.NewQuery(kind).
+			Filter("Expires>=", lo).
+			Filter("Expires<", hi).
+			Order("Expires").
+			Limit(opts.BatchSize).
+			KeysOnly()
+
+		wg.Add(1)
+		go func(i int, q *datastore.Query) {
+			defer wg.Done()
+			errs[i] = collectGarbage(c, q, opts.BatchSize, quittingTime, budget, &shardStats[i])
+		}(i, q)
+	}
+	wg.Wait()
+	for i := range shardStats {
+		stats.add(shardStats[i])
+	}
+
+	// a real error is more interesting than a timeout
+	err = nil
+	for _, e := range errs {
+		if e == CollectGarbageTimeout || e == CollectGarbageBudgetReached {
+			err = e
+		} else if e != nil {
+			return e
+		}
+	}
+	return err
 }
 
 // Note_eventual:
@@ -0,0 +1,232 @@
+package kvs
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jjhendricks/aeds"
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// Leaderboard caches the top N entities of a kind, ordered by a numeric
+// property, in a single KV.  Top serves the cached list, rebuilding it from
+// the datastore when it's missing.  Call Update after storing an entity and
+// Remove after deleting one so the list stays current without rebuilding.
+// See Note_leaderboard
+//
+// The datastore needs a descending index on Field, which it keeps for single
+// properties automatically.
+type Leaderboard struct {
+	// Kind is the kind of entity being ranked.
+	Kind string
+
+	// Field names the property holding each entity's score.  Its values
+	// must be integers or floats.
+	Field string
+
+	// N is the number of entities kept in the list.  It must be positive.
+	N int
+
+	// Ttl describes how long a rebuilt list is cached before it's rebuilt
+	// again.  Zero means until it's invalidated.
+	Ttl time.Duration
+}
+
+// LeaderboardEntry is one ranked entity
+type LeaderboardEntry struct {
+	Key   *datastore.Key
+	Score float64
+}
+
+// kvKey returns the key of the KV holding this leaderboard
+func (lb *Leaderboard) kvKey() string {
+	return fmt.Sprintf("leaderboard: %s: %s", lb.Kind, lb.Field)
+}
+
+// Top returns the leaderboard's entries, highest score first.  If the list
+// isn't cached, it's rebuilt with a datastore query.
+func (lb *Leaderboard) Top(c context.Context) ([]LeaderboardEntry, error) {
+	kv, err := Find(c, lb.kvKey())
+	if IsNotFound(err) {
+		return lb.Rebuild(c)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []LeaderboardEntry
+	err = kv.Decode(&entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Rebuild replaces the cached list with the results of a datastore query and
+// returns them.  Like any query, it's eventually consistent.
+func (lb *Leaderboard) Rebuild(c context.Context) ([]LeaderboardEntry, error) {
+	var rows []datastore.PropertyList
+	q := datastore.NewQuery(lb.Kind).
+		Order("-" + lb.Field).
+		Project(lb.Field).
+		Limit(lb.N)
+	keys, err := aeds.QueryConsistency(c, q).GetAll(c, &rows)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]LeaderboardEntry, 0, len(keys))
+	for i, key := range keys {
+		for _, p := range rows[i] {
+			if p.Name != lb.Field {
+				continue
+			}
+			score, err := leaderboardScore(p.Value)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, LeaderboardEntry{Key: key, Score: score})
+		}
+	}
+
+	kv := &KV{Key: lb.kvKey(), Ttl: lb.Ttl}
+	err = kv.Encode(entries)
+	if err != nil {
+		return nil, err
+	}
+	err = kv.Put(c)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Update records a new score for the entity with the given key.  If the score
+// places it in the top N, it's added or moved.  If an entity already in the
+// list drops to the bottom, the list is invalidated since some other entity
+// might now belong in its place.  Does nothing if the list isn't cached.
+func (lb *Leaderboard) Update(c context.Context, key *datastore.Key, score float64) error {
+	return lb.modify(c, func(entries []LeaderboardEntry) ([]LeaderboardEntry, int) {
+		i := leaderboardIndex(entries, key)
+		dropped := i >= 0 && score < entries[i].Score
+		if i >= 0 {
+			entries = append(entries[:i], entries[i+1:]...)
+		} else if len(entries) >= lb.N && score <= entries[len(entries)-1].Score {
+			return entries, leaderboardUnchanged // doesn't make the cut
+		}
+
+		entries = append(entries, LeaderboardEntry{Key: key, Score: score})
+		sort.Stable(byScore(entries))
+		if len(entries) > lb.N {
+			entries = entries[:lb.N]
+		}
+		last := entries[len(entries)-1].Key.Equal(key)
+		if dropped && last && len(entries) == lb.N {
+			return nil, leaderboardInvalid
+		}
+		return entries, leaderboardChanged
+	})
+}
+
+// Remove takes the entity with the given key off the leaderboard, as after
+// deleting it.  A full list is invalidated, since another entity moves into
+// the top N.  Does nothing if the list isn't cached.
+func (lb *Leaderboard) Remove(c context.Context, key *datastore.Key) error {
+	return lb.modify(c, func(entries []LeaderboardEntry) ([]LeaderboardEntry, int) {
+		i := leaderboardIndex(entries, key)
+		if i < 0 {
+			return entries, leaderboardUnchanged
+		}
+		if len(entries) >= lb.N {
+			return nil, leaderboardInvalid
+		}
+		return append(entries[:i], entries[i+1:]...), leaderboardChanged
+	})
+}
+
+// outcomes of a change to a leaderboard
+const (
+	leaderboardUnchanged = iota
+	leaderboardChanged
+	leaderboardInvalid // the list must be rebuilt
+)
+
+// modify changes a cached leaderboard in a transaction.  f returns the new
+// entries and one of the leaderboard outcome constants.
+func (lb *Leaderboard) modify(c context.Context, f func([]LeaderboardEntry) ([]LeaderboardEntry, int)) error {
+	if lb.N <= 0 {
+		return fmt.Errorf("kvs: Leaderboard.N must be positive, got %d", lb.N)
+	}
+
+	invalidate := false
+	err := Modify(c, lb.kvKey(), func(kv *KV, ok bool) error {
+		invalidate = false
+		if !ok {
+			return errUnchanged // Top will rebuild it
+		}
+
+		var entries []LeaderboardEntry
+		err := kv.Decode(&entries)
+		if err != nil {
+			return err
+		}
+		entries, outcome := f(entries)
+		switch outcome {
+		case leaderboardUnchanged:
+			return errUnchanged
+		case leaderboardInvalid:
+			invalidate = true
+			return errUnchanged
+		}
+		return kv.Encode(entries)
+	})
+	if err == errUnchanged {
+		err = nil
+	}
+	if err != nil || !invalidate {
+		return err
+	}
+
+	kv := &KV{Key: lb.kvKey()}
+	return kv.Delete(c)
+}
+
+// leaderboardIndex returns the position of key in entries, or -1
+func leaderboardIndex(entries []LeaderboardEntry, key *datastore.Key) int {
+	for i := range entries {
+		if entries[i].Key.Equal(key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// leaderboardScore converts a projected property value to a score
+func leaderboardScore(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("kvs: leaderboard score must be a number, got %T", value)
+}
+
+// byScore sorts leaderboard entries, highest score first
+type byScore []LeaderboardEntry
+
+func (es byScore) Len() int           { return len(es) }
+func (es byScore) Swap(i, j int)      { es[i], es[j] = es[j], es[i] }
+func (es byScore) Less(i, j int) bool { return es[i].Score > es[j].Score }
+
+// Note_leaderboard
+//
+// Update and Remove only ever see the cached top N, so they can't tell which
+// entity ranks N+1.  Whenever that entity might belong in the list, because a
+// member's score fell to the bottom or a member of a full list was removed,
+// the whole list is invalidated and the next Top rebuilds it.  Otherwise the
+// cached list stays exact.  A list with fewer than N entries means the kind
+// has fewer than N entities, so any newcomer belongs in it.
@@ -0,0 +1,86 @@
+package kvs
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// A list stores a bounded sequence of values under a single key.  The values
+// are kept as a gob-encoded [][]byte in one KV, oldest first.  Like hashes,
+// each push is a datastore transaction on the whole list, so concurrent pushes
+// are never lost.
+
+// LPush appends value to the list at key k.  If the list then holds more than
+// maxLen values, the oldest ones are discarded.  A maxLen of zero or less
+// leaves the list unbounded.  If ttl is positive, the whole list expires after
+// ttl.  Otherwise, the list's existing expiration is unchanged.
+func LPush(c context.Context, k string, value []byte, ttl time.Duration, maxLen int) error {
+	return Modify(c, k, func(kv *KV, ok bool) error {
+		values, err := kv.listValues(ok)
+		if err != nil {
+			return err
+		}
+
+		values = append(values, value)
+		if maxLen > 0 && len(values) > maxLen {
+			values = values[len(values)-maxLen:]
+		}
+		if ttl > 0 {
+			kv.Ttl = ttl
+		}
+		return kv.Encode(values)
+	})
+}
+
+// LRange returns the values of the list at key k from index start through
+// index stop, inclusive.  Index 0 is the oldest value.  Negative indexes
+// count backwards from the newest value, so LRange(c, k, -10, -1) returns the
+// ten most recent values.  Out of range indexes are clamped to the list's
+// bounds.  A missing list is empty.
+func LRange(c context.Context, k string, start, stop int) ([][]byte, error) {
+	kv, err := Find(c, k)
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	values, err := kv.listValues(true)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(values)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return nil, nil
+	}
+	return values[start : stop+1], nil
+}
+
+// listValues decodes a KV's value as a list.  If the KV doesn't exist (ok is
+// false), the list is empty.
+func (kv *KV) listValues(ok bool) ([][]byte, error) {
+	if !ok || len(kv.Value) == 0 {
+		return nil, nil
+	}
+
+	var values [][]byte
+	err := kv.Decode(&values)
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
@@ -0,0 +1,111 @@
+package kvs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/jjhendricks/aeds"
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+var LockNotHeld = errors.New("Lock is not held by this token")
+
+// Lock tries to acquire a distributed lock named k.  If the lock is free, it's
+// acquired and Lock returns a random token identifying this holder, along with
+// true.  If someone else holds the lock, Lock returns false.
+//
+// The lock is stored as an ordinary KV whose value is the token.  It expires
+// after ttl so that a holder which crashes can't block everyone else forever.
+// Choose a ttl comfortably longer than the work done while holding the lock.
+func Lock(c context.Context, k string, ttl time.Duration) (string, bool, error) {
+	if aeds.IsReadOnly() {
+		return "", false, aeds.ErrReadOnly
+	}
+
+	token, err := newLockToken()
+	if err != nil {
+		return "", false, err
+	}
+	err = filterAdd(c, k)
+	if err != nil {
+		return "", false, err
+	}
+
+	var item *memcache.Item
+	acquired := false
+	key := datastore.NewKey(c, Kind, k, 0, nil)
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		acquired = false
+
+		var old KV
+		err := datastore.Get(c, key, &old)
+		if err == nil && !old.isExpired() {
+			return nil // someone else holds the lock
+		}
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		kv := &KV{Key: k, Value: []byte(token), Ttl: ttl}
+		item = kv.memcacheItem()
+		_, err = datastore.Put(c, key, kv)
+		acquired = err == nil
+		return err
+	}, nil)
+	if err != nil || !acquired {
+		return "", false, err
+	}
+
+	err = memcache.Set(c, item)
+	_ = err // memcache is an optimization. ignore errors
+	return token, true, nil
+}
+
+// Unlock releases a lock previously acquired with Lock.  The lock is only
+// released if token matches the one returned by Lock, so one process can't
+// release a lock held by another.  Returns LockNotHeld if the token doesn't
+// match or the lock has already expired.
+func Unlock(c context.Context, k, token string) error {
+	if aeds.IsReadOnly() {
+		return aeds.ErrReadOnly
+	}
+
+	key := datastore.NewKey(c, Kind, k, 0, nil)
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		var kv KV
+		err := datastore.Get(c, key, &kv)
+		if err == datastore.ErrNoSuchEntity {
+			return LockNotHeld
+		}
+		if err != nil {
+			return err
+		}
+		if kv.isExpired() || string(kv.Value) != token {
+			return LockNotHeld
+		}
+
+		return datastore.Delete(c, key)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	err = memcache.Delete(c, memKey(k))
+	_ = err // memcache is an optimization. ignore errors.
+	return nil
+}
+
+// newLockToken returns a random token identifying a lock holder
+func newLockToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,40 @@
+package kvs
+
+import (
+	"time"
+
+	"google.golang.org/appengine/memcache"
+)
+
+// MaxAge bounds how long Find trusts a value in memcache.  A value copied to
+// memcache longer ago than MaxAge is ignored and read again from the
+// datastore, even if its memcache item hasn't expired.  See Note_maxage
+//
+// Defaults to 0, which means no limit.
+var MaxAge time.Duration
+
+// stampItem records the current time in a memcache item about to be stored
+func stampItem(item *memcache.Item) {
+	item.Flags = uint32(time.Now().Unix())
+}
+
+// tooOld returns true if MaxAge says a memcache item shouldn't be trusted
+func tooOld(item *memcache.Item) bool {
+	if MaxAge <= 0 {
+		return false
+	}
+	if item.Flags == 0 {
+		return true // written before items were stamped
+	}
+	stored := time.Unix(int64(item.Flags), 0)
+	return time.Now().Sub(stored) > MaxAge
+}
+
+// Note_maxage
+//
+// The time a value was copied to memcache is kept in its item's Flags, as a
+// Unix time in seconds, rather than in the value itself.  Instances which
+// predate MaxAge ignore Flags, so they keep reading values correctly during a
+// rollout.  Their own items have zero Flags, which counts as too old whenever
+// MaxAge is set.  That keeps the staleness bound, at the cost of extra
+// datastore reads until every instance stamps its items.
@@ -0,0 +1,267 @@
+package kvs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jjhendricks/aeds"
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+var MigrateKeysTimeout = errors.New("MigrateKeys timed out")
+
+// Migration defines options for MigrateKeys.
+type Migration struct {
+	// Name identifies the migration's checkpoint, so that each call
+	// resumes where the last one stopped.  Start a new migration by
+	// choosing a new name.  Required.
+	Name string
+
+	// Ttl describes how much time a single call should be allowed to run.
+	// Like GC.Ttl, it's only a guideline.
+	//
+	// Defaults to 50 seconds.
+	Ttl time.Duration
+
+	// BatchSize is the number of keys fetched by each query.  Each KV is
+	// still moved in its own transaction.  It may not exceed MaxBatchSize.
+	//
+	// Defaults to 100.
+	BatchSize int
+}
+
+// migrationCheckpoint records how far a migration has progressed
+type migrationCheckpoint struct {
+	Cursor   string `datastore:",noindex"`
+	Migrated int    `datastore:",noindex"`
+	Done     bool   `datastore:",noindex"`
+}
+
+// migrationKind returns the datastore kind for migration checkpoints
+func migrationKind() string {
+	return Kind + "-migrations"
+}
+
+// MigrateKeys moves KVs to a new key scheme.  It scans every KV and calls
+// transform with its key.  If keep is false, the KV is deleted.  If the new
+// key differs, the KV is written under the new key and the old one is
+// deleted, in a single cross-group transaction.  Returns the number of KVs
+// moved or deleted by this call.  See Note_migrate
+//
+// Progress is saved in a checkpoint named by opts.Name after each batch.  If
+// opts.Ttl is reached, returns MigrateKeysTimeout and the next call with the
+// same name resumes from the checkpoint, so a cron job can call MigrateKeys
+// repeatedly until it returns nil.  Once a migration finishes, later calls
+// with its name do nothing.
+//
+// transform must map keys which already follow the new scheme to themselves,
+// since KVs written under new keys can show up later in the same scan.
+func MigrateKeys(c context.Context, transform func(old string) (new string, keep bool), opts *Migration) (int, error) {
+	if aeds.IsReadOnly() {
+		return 0, aeds.ErrReadOnly
+	}
+	if opts == nil || opts.Name == "" {
+		return 0, errors.New("kvs: MigrateKeys needs Migration.Name")
+	}
+	ttl := opts.Ttl
+	if ttl == 0 {
+		ttl = 50 * time.Second
+	}
+	batchSize := opts.BatchSize
+	if batchSize == 0 {
+		batchSize = 100
+	}
+	if batchSize < 0 || batchSize > MaxBatchSize {
+		return 0, fmt.Errorf("Migration.BatchSize must be between 1 and %d, got %d", MaxBatchSize, batchSize)
+	}
+	quittingTime := time.Now().Add(ttl)
+
+	checkpointKey := datastore.NewKey(c, migrationKind(), opts.Name, 0, nil)
+	var checkpoint migrationCheckpoint
+	err := datastore.Get(c, checkpointKey, &checkpoint)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return 0, err
+	}
+	if checkpoint.Done {
+		return 0, nil
+	}
+
+	n := 0
+	q := datastore.NewQuery(Kind).Limit(batchSize).KeysOnly()
+	for {
+		err := c.Err()
+		if err != nil {
+			return n, err
+		}
+		if time.Now().After(quittingTime) {
+			return n, MigrateKeysTimeout
+		}
+
+		batch := q
+		if checkpoint.Cursor != "" {
+			cursor, err := datastore.DecodeCursor(checkpoint.Cursor)
+			if err != nil {
+				return n, err
+			}
+			batch = q.Start(cursor)
+		}
+		keys, cursor, err := getAllKeys(c, batch)
+		if err != nil {
+			return n, err
+		}
+
+		for _, key := range keys {
+			old := key.StringID()
+			k, keep := transform(old)
+			if keep && k == old {
+				continue
+			}
+			if !keep {
+				k = ""
+			}
+			moved, err := migrateKey(c, old, k)
+			if err != nil {
+				return n, err
+			}
+			if moved {
+				n++
+				checkpoint.Migrated++
+			}
+		}
+
+		checkpoint.Cursor = cursor.String()
+		checkpoint.Done = len(keys) < batchSize
+		_, err = datastore.Put(c, checkpointKey, &checkpoint)
+		if err != nil {
+			return n, err
+		}
+		if checkpoint.Done {
+			return n, nil
+		}
+	}
+}
+
+// migrateKey moves the KV with key old to key k, or deletes it if k is
+// empty.  Returns false if there was nothing to do.
+func migrateKey(c context.Context, old, k string) (bool, error) {
+	oldKey := datastore.NewKey(c, Kind, old, 0, nil)
+	var newKey *datastore.Key
+	if k != "" {
+		newKey = datastore.NewKey(c, Kind, k, 0, nil)
+		err := filterAdd(c, k)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// a pending PutLater would recreate the old key.  See Note_migrate
+	err := persist(c, old)
+	if err != nil {
+		return false, err
+	}
+	err = memcache.Delete(c, pendingKey(old))
+	if err != nil && err != memcache.ErrCacheMiss {
+		return false, err
+	}
+
+	moved := false
+	var replaced []byte  // stored value under the old key
+	var written [][]byte // stored values written by each attempt
+	opts := &datastore.TransactionOptions{XG: true}
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		moved = false
+		var kv KV
+		err := datastore.Get(c, oldKey, &kv)
+		if err == datastore.ErrNoSuchEntity {
+			return nil // already moved or deleted
+		}
+		if err != nil {
+			return err
+		}
+		replaced = kv.Value
+		if newKey == nil {
+			moved = true
+			return datastore.Delete(c, oldKey)
+		}
+
+		var existing KV
+		err = datastore.Get(c, newKey, &existing)
+		if err == nil {
+			log.Warningf(c, "kvs: not migrating %q since %q already exists", old, k)
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		// values are sealed with their key, so reseal under the new one
+		value, err := loadValue(c, kv.Value)
+		if err != nil {
+			return err
+		}
+		value, err = openValue(old, value)
+		if err != nil {
+			return err
+		}
+		stored := kv
+		stored.Key = k
+		stored.Value, err = sealValue(k, value)
+		if err != nil {
+			return err
+		}
+		stored.Value, err = storeValue(c, k, stored.Value)
+		if err != nil {
+			return err
+		}
+		written = append(written, stored.Value)
+
+		_, err = datastore.Put(c, newKey, &stored)
+		if err != nil {
+			return err
+		}
+		moved = true
+		return datastore.Delete(c, oldKey)
+	}, opts)
+
+	// remove objects which were replaced or never committed
+	for i, value := range written {
+		if err != nil || !moved || i < len(written)-1 {
+			replaceBlob(c, value, nil)
+		}
+	}
+	if err != nil || !moved {
+		return false, err
+	}
+	replaceBlob(c, replaced, nil)
+
+	// Find refills the new key from datastore
+	memKeys := []string{memKey(old)}
+	if k != "" {
+		memKeys = append(memKeys, memKey(k))
+	}
+	err = memcache.DeleteMulti(c, memKeys)
+	_ = err // memcache is an optimization. ignore errors
+	return true, nil
+}
+
+// Note_migrate
+//
+// Each KV is its own entity group, so moving one takes a cross-group
+// transaction covering the old key and the new one.  That keeps a
+// concurrent Put or Modify of the old key from being lost: either it
+// commits first and its value is moved, or the move commits first and the
+// write recreates the old key.  Switch writers to the new scheme before
+// migrating so that doesn't happen.  If a KV already exists under the new
+// key, it was written by code using the new scheme and it wins.  The old KV
+// is left in place and a warning is logged.
+//
+// A write pending from PutLater is persisted before its KV moves, then
+// discarded, so its flush can't recreate the old key.
+//
+// History kept for the old key isn't moved.  History still finds it under
+// the old key.
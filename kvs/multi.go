@@ -0,0 +1,129 @@
+package kvs
+
+import (
+	"time"
+
+	"github.com/jjhendricks/aeds"
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// FindMulti is like Find for several keys at once.  It returns the KVs which
+// were found, by key.  Keys which don't exist or have expired are left out of
+// both maps.  A key which couldn't be read has its error in errs instead, so
+// one bad key doesn't hide the others.  errs is nil if every key was either
+// found or missing.  With Filter set, keys which definitely don't exist are
+// never looked up in the datastore.
+func FindMulti(c context.Context, keys []string) (found map[string]*KV, errs map[string]error) {
+	found = make(map[string]*KV, len(keys))
+	fail := func(k string, err error) {
+		if errs == nil {
+			errs = make(map[string]error)
+		}
+		errs[k] = err
+	}
+	keep := func(kv *KV) {
+		value, err := loadValue(c, kv.Value)
+		if err == nil {
+			value, err = openValue(kv.Key, value)
+		}
+		if err != nil {
+			fail(kv.Key, err)
+			return
+		}
+		kv.Value = value
+		found[kv.Key] = kv
+	}
+
+	// which kvs are in memcache?
+	bypass := aeds.BypassesCache(c)
+	var items map[string]*memcache.Item
+	if !bypass {
+		memcacheKeys := make([]string, len(keys))
+		for i, k := range keys {
+			memcacheKeys[i] = memKey(k)
+		}
+		var err error
+		items, err = memcache.GetMulti(c, memcacheKeys)
+		_ = err // memcache is an optimization. ignore errors
+	}
+	var lookup []string
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		item, ok := items[memKey(k)]
+		if ok && !tooOld(item) {
+			keep(&KV{Key: k, Value: item.Value})
+		} else {
+			lookup = append(lookup, k)
+		}
+	}
+
+	// the filter may rule some out.  See Note_bloom
+	if !bypass {
+		absent := filterAbsent(c, lookup)
+		rest := lookup[:0]
+		for _, k := range lookup {
+			if !absent[k] {
+				rest = append(rest, k)
+			}
+		}
+		lookup = rest
+	}
+
+	// look in the datastore for the rest
+	var fill []*memcache.Item
+	for start := 0; start < len(lookup); start += MaxBatchSize {
+		end := start + MaxBatchSize
+		if end > len(lookup) {
+			end = len(lookup)
+		}
+		batch := lookup[start:end]
+		dsKeys := make([]*datastore.Key, len(batch))
+		for i, k := range batch {
+			dsKeys[i] = datastore.NewKey(c, Kind, k, 0, nil)
+		}
+		kvs := make([]KV, len(batch))
+		err := datastore.GetMulti(c, dsKeys, kvs)
+		merr, _ := err.(appengine.MultiError)
+		for i, k := range batch {
+			switch {
+			case err != nil && merr == nil:
+				fail(k, err) // the whole batch failed
+				continue
+			case merr != nil && merr[i] == datastore.ErrNoSuchEntity:
+				continue
+			case merr != nil && merr[i] != nil:
+				fail(k, merr[i])
+				continue
+			}
+			kv := &kvs[i]
+			if kv.isExpired() {
+				continue // pretend it doesn't exist
+			}
+
+			item := &memcache.Item{
+				Key:   memKey(k),
+				Value: kv.Value,
+			}
+			stampItem(item)
+			item.Expiration = memcacheExpiration(kv.Expires, time.Now())
+			fill = append(fill, item)
+			kv.Key = k
+			keep(kv)
+		}
+	}
+
+	// store results in memcache for later
+	if !bypass && len(fill) > 0 {
+		err := memcache.SetMulti(c, fill)
+		_ = err // memcache is an optimization. ignore errors
+	}
+	return found, errs
+}
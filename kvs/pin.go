@@ -0,0 +1,37 @@
+package kvs
+
+import (
+	"google.golang.org/appengine/datastore"
+)
+
+// Load implements datastore.PropertyLoadSaver.
+func (kv *KV) Load(props []datastore.Property) error {
+	return datastore.LoadStruct(kv, props)
+}
+
+// Save implements datastore.PropertyLoadSaver.  A pinned KV's expiration is
+// stored without an index.  See Note_pinned
+func (kv *KV) Save() ([]datastore.Property, error) {
+	props, err := datastore.SaveStruct(kv)
+	if err != nil {
+		return nil, err
+	}
+	if kv.Pinned {
+		for i := range props {
+			if props[i].Name == "Expires" {
+				props[i].NoIndex = true
+			}
+		}
+	}
+	return props, nil
+}
+
+// Note_pinned
+//
+// CollectGarbage and ExpiringBefore find KVs with a query on the Expires
+// index.  Excluding pinned KVs with an equality filter would need a composite
+// index, and KVs written before Pinned existed have no Pinned property, so
+// they'd never match "Pinned =" false.  Instead, a pinned KV stores Expires
+// without indexing it, which keeps it out of those queries entirely.  Find
+// still honors its expiration.  Writing it again with Pinned false restores
+// the index, making it eligible for collection once more.
@@ -0,0 +1,26 @@
+package kvs
+
+import (
+	"google.golang.org/protobuf/proto"
+)
+
+// EncodeProto sets the Value field to the protobuf wire encoding of m.  Unlike
+// Encode, the result can be decoded by services written in other languages.
+//
+// Values don't record which codec produced them, so a key written with
+// EncodeProto must be read with DecodeProto.  Mixing codecs on one key is
+// unsupported.
+func (kv *KV) EncodeProto(m proto.Message) error {
+	value, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	kv.Value = value
+	return nil
+}
+
+// DecodeProto extracts the Value field by protobuf decoding into m.
+func (kv *KV) DecodeProto(m proto.Message) error {
+	return proto.Unmarshal(kv.Value, m)
+}
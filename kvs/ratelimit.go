@@ -0,0 +1,76 @@
+package kvs
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/memcache"
+)
+
+// RateLimiter enforces fixed-window rate limits.  Each window has its own
+// counter which lives in memcache and expires when the window ends.
+//
+// Counters are never written to datastore.  If memcache evicts a counter, that
+// window's count starts over.  So a RateLimiter occasionally allows more than
+// limit events, but it never blocks events it shouldn't.
+type RateLimiter struct {
+	// Name distinguishes this limiter's counters from those of other
+	// limiters which might use the same keys.
+	Name string
+}
+
+// Allow records an event for key and reports whether the event is within
+// limit for the current window.  Windows are aligned to multiples of window
+// since the zero time, so every instance agrees on when a window begins and
+// ends.  window must be positive.
+func (r RateLimiter) Allow(c context.Context, key string, limit int, window time.Duration) (bool, error) {
+	now := time.Now()
+	start := now.Truncate(window)
+	counter := memKey(fmt.Sprintf("ratelimit: %s: %s: %d", r.Name, key, start.UnixNano()))
+
+	n, err := memcache.IncrementExisting(c, counter, 1)
+	if err == memcache.ErrCacheMiss {
+		// first hit in this window (See Note_window)
+		item := &memcache.Item{
+			Key:        counter,
+			Value:      []byte("1"),
+			Expiration: roundUpToSecond(start.Add(window).Sub(now)),
+		}
+		err = memcache.Add(c, item)
+		switch err {
+		case nil:
+			n = 1
+		case memcache.ErrNotStored:
+			// someone else started the window first
+			n, err = memcache.IncrementExisting(c, counter, 1)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return n <= uint64(limit), nil
+}
+
+// roundUpToSecond rounds d up to a whole number of seconds
+func roundUpToSecond(d time.Duration) time.Duration {
+	rounded := d.Truncate(time.Second)
+	if rounded < d {
+		rounded += time.Second
+	}
+	return rounded
+}
+
+// Note_window
+//
+// memcache.Increment can create a missing counter, but the counter it creates
+// never expires.  So we only increment counters which already exist and
+// create new ones with memcache.Add, which lets us set an expiration.  If two
+// requests both see a missing counter, only one Add succeeds and the other
+// falls back to incrementing.
+//
+// memcache ignores fractions of a second in expirations.  Near the end of a
+// window, the remaining time might be less than a second and would be stored as
+// zero, which means "never expire."  Rounding up avoids that.
@@ -0,0 +1,128 @@
+package kvs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jjhendricks/aeds"
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// how long one caller may spend recomputing a value before others give up
+// waiting and recompute it themselves
+const refreshLockTtl = 10 * time.Second
+
+// how often waiting callers check for a recomputed value
+const refreshPoll = 100 * time.Millisecond
+
+// Refresh returns the KV for key k, recomputing it if it's absent or
+// expired.  fn receives the old value (nil if there was none, possibly
+// expired) and returns the new one, which is stored with the given ttl.
+//
+// Concurrent callers don't stampede.  One of them takes a short memcache
+// lock and calls fn, while the others wait for its result.  The new value is
+// stored transactionally, so if another caller stored a fresh value first,
+// that value is returned and fn's result is discarded.  fn runs outside any
+// transaction and may take a while, but it shouldn't take longer than about
+// 10 seconds.
+func Refresh(c context.Context, k string, ttl time.Duration, fn func(old []byte) ([]byte, error)) (*KV, error) {
+	kv, err := Find(c, k)
+	if !IsNotFound(err) {
+		return kv, err
+	}
+	if aeds.IsReadOnly() {
+		return nil, aeds.ErrReadOnly
+	}
+
+	// is someone else already recomputing it?
+	lock := &memcache.Item{
+		Key:        refreshLockKey(k),
+		Value:      []byte{},
+		Expiration: refreshLockTtl,
+	}
+	err = memcache.Add(c, lock)
+	if err == memcache.ErrNotStored {
+		for deadline := time.Now().Add(refreshLockTtl); time.Now().Before(deadline); {
+			select {
+			case <-time.After(refreshPoll):
+			case <-c.Done():
+				return nil, c.Err()
+			}
+			kv, err := Find(c, k)
+			if !IsNotFound(err) {
+				return kv, err
+			}
+		}
+		// they seem to have failed. do it ourselves
+	} else if err == nil {
+		defer memcache.Delete(c, lock.Key)
+	}
+	// otherwise ignore memcache errors
+
+	// recompute from the old value, even if it's expired
+	var old KV
+	err = datastore.Get(c, datastore.NewKey(c, Kind, k, 0, nil), &old)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	if err == nil {
+		old.Value, err = loadValue(c, old.Value)
+		if err != nil {
+			return nil, err
+		}
+		old.Value, err = openValue(k, old.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	value, err := fn(old.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	// store it, unless someone beat us to it
+	var result KV
+	err = Modify(c, k, func(kv *KV, ok bool) error {
+		if !ok {
+			kv.Value = value
+			kv.Expires = time.Time{}
+			kv.Ttl = ttl
+		}
+		result = *kv
+		if ok {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil && err != errUnchanged {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// returns the memcache key used to lock a KV while it's recomputed
+func refreshLockKey(key string) string {
+	return fmt.Sprintf("%s refresh: %s", Kind, key)
+}
+
+// Memoize returns the value stored at key k, calling fn to compute and store
+// it if it's absent or expired.  It's a general memoization primitive built
+// on Refresh, for caching anything expensive to compute: rendered templates,
+// responses from third-party APIs and so on.  Choose keys which include every
+// argument affecting the result.
+//
+// As with Refresh, concurrent callers share one call to fn rather than
+// stampeding.  Values are kept in memcache and the datastore, so they survive
+// memcache evictions.
+func Memoize(c context.Context, k string, ttl time.Duration, fn func() ([]byte, error)) ([]byte, error) {
+	kv, err := Refresh(c, k, ttl, func([]byte) ([]byte, error) {
+		return fn()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kv.Value, nil
+}
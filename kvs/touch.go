@@ -0,0 +1,101 @@
+package kvs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jjhendricks/aeds"
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// Touch is like TouchMulti for a single key.
+func Touch(c context.Context, k string, ttl time.Duration) error {
+	return TouchMulti(c, []string{k}, ttl)
+}
+
+// TouchMulti makes each of the given KVs expire ttl from now, leaving their
+// values alone.  It's meant for refreshing many sessions at once.  KVs which
+// don't exist or have already expired are skipped.  ttl must be positive.
+//
+// Each batch of keys is read and written with one GetMulti and one PutMulti,
+// outside of any transaction.  A concurrent write to one of the keys might be
+// lost, so don't mix TouchMulti with Modify on the same keys.
+func TouchMulti(c context.Context, ks []string, ttl time.Duration) error {
+	if aeds.IsReadOnly() {
+		return aeds.ErrReadOnly
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("kvs: TouchMulti needs a positive ttl, got %s", ttl)
+	}
+
+	for start := 0; start < len(ks); start += MaxBatchSize {
+		end := start + MaxBatchSize
+		if end > len(ks) {
+			end = len(ks)
+		}
+		err := touchBatch(c, ks[start:end], ttl)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// touchBatch does the work of TouchMulti for at most MaxBatchSize keys
+func touchBatch(c context.Context, ks []string, ttl time.Duration) error {
+	keys := make([]*datastore.Key, len(ks))
+	for i, k := range ks {
+		keys[i] = datastore.NewKey(c, Kind, k, 0, nil)
+	}
+	kvs := make([]KV, len(ks))
+	err := datastore.GetMulti(c, keys, kvs)
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
+		return err
+	}
+
+	var touchedKeys []*datastore.Key
+	var touched []*KV
+	var items []*memcache.Item
+	now := time.Now()
+	expires := now.Add(ttl)
+	for i := range kvs {
+		if merr != nil && merr[i] == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if merr != nil && merr[i] != nil {
+			return merr[i]
+		}
+		kv := &kvs[i]
+		if kv.isExpired() {
+			continue
+		}
+
+		// values are stored sealed, so they can be copied as they are
+		kv.Expires = expires
+		touchedKeys = append(touchedKeys, keys[i])
+		touched = append(touched, kv)
+		item := &memcache.Item{
+			Key:        memKey(ks[i]),
+			Value:      kv.Value,
+			Expiration: memcacheExpiration(expires, now),
+		}
+		stampItem(item)
+		items = append(items, item)
+	}
+	if len(touched) == 0 {
+		return nil
+	}
+
+	_, err = datastore.PutMulti(c, touchedKeys, touched)
+	if err != nil {
+		return err
+	}
+	err = memcache.SetMulti(c, items)
+	_ = err // memcache is an optimization. ignore errors
+	return nil
+}
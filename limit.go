@@ -0,0 +1,72 @@
+package aeds
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// MaxConcurrentRPCs limits how many datastore calls the functions which read
+// or write entities have in flight at once on this instance.  That covers
+// Get, GetMulti, Put, PutMulti, PutGetOld, Modify, Delete, FromId,
+// ExistsMulti, WarmCache, FetchRaw, LoadHeavy, PutTx, DeleteTx, FromIdTx and
+// the loading and deleting done by Export, RecomputeAll, Mapper,
+// DeleteAllOfKind and DeleteAllOf.  Batches count one slot per datastore
+// call.  Once the limit is reached, further calls wait for a slot, or until
+// their context is done, rather than piling onto the datastore during a
+// burst.  A slot is only held during a single call, never while hooks run.
+//
+// Queries, transaction commits and bookkeeping, like the checkpoints kept by
+// Mapper, ImportFrom and RecomputeAll, aren't limited.  Neither are the
+// diagnostics Inspect and Ping.
+//
+// Zero, the default, means no limit.  Set it during initialization.  Later
+// changes are ignored.
+var MaxConcurrentRPCs int
+
+var rpcSlots chan struct{}
+var rpcSlotsOnce sync.Once
+var rpcsInFlight int32
+
+// RPCsInFlight returns the number of datastore calls currently holding a slot
+// under MaxConcurrentRPCs.  It's always zero without a limit.
+func RPCsInFlight() int {
+	return int(atomic.LoadInt32(&rpcsInFlight))
+}
+
+// acquireRPC waits for a slot under MaxConcurrentRPCs.  On success, the
+// result must be called to release the slot.  Returns the context's error if
+// it's done first.
+func acquireRPC(c context.Context) (func(), error) {
+	rpcSlotsOnce.Do(func() {
+		if MaxConcurrentRPCs > 0 {
+			rpcSlots = make(chan struct{}, MaxConcurrentRPCs)
+		}
+	})
+	if rpcSlots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case rpcSlots <- struct{}{}:
+	case <-c.Done():
+		return nil, c.Err()
+	}
+	atomic.AddInt32(&rpcsInFlight, 1)
+	return func() {
+		atomic.AddInt32(&rpcsInFlight, -1)
+		<-rpcSlots
+	}, nil
+}
+
+// limited calls f, which makes one datastore call, while holding a slot
+// under MaxConcurrentRPCs
+func limited(c context.Context, f func() error) error {
+	release, err := acquireRPC(c)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return f()
+}
@@ -0,0 +1,426 @@
+package aeds
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// MapFunc is called by a Mapper for each entity of its kind.  Returning an
+// error makes the task retry the current batch.
+type MapFunc func(c context.Context, e Entity) error
+
+// Mapper calls a MapFunc for every entity of a kind, using several task queue
+// tasks in parallel.  The kind's key space is split into Shards ranges and each
+// range is processed in key order by its own chain of tasks.  Progress is
+// checkpointed after each batch, so a failed task resumes where it left off.
+// See Note_mapper
+//
+// Since a batch may be retried, Map must tolerate seeing an entity more than
+// once.  Mappers must be registered with RegisterMapper during init, on every
+// instance which might run their tasks.
+type Mapper struct {
+	// Name identifies the mapper in tasks and checkpoints.  It must be
+	// unique and may only contain letters, digits, '-' and '_'.
+	Name string
+
+	// Kind is the kind of entity to map over.
+	Kind string
+
+	// Proto supplies the type of entity which is loaded and given to Map.  It
+	// must implement CanSetStringId, so that each entity gets the id from
+	// its key and Map can put it back.
+	Proto Entity
+
+	// Map is called for each entity.
+	Map MapFunc
+
+	// Shards is the number of key ranges processed in parallel.  There may
+	// be fewer, if the kind is small.
+	//
+	// Defaults to 8.
+	Shards int
+
+	// Queue names the task queue for the mapper's tasks.
+	//
+	// Defaults to "", the default queue.
+	Queue string
+}
+
+// mapper details which aren't configurable
+const (
+	defaultMapShards = 8
+	mapOversample    = 32              // scatter keys sampled per shard
+	mapSlice         = 5 * time.Minute // how long a task runs before handing off
+	mapperKind       = "mappers"
+	mapperShardKind  = "mapper-shards"
+)
+
+// mappers holds every Mapper registered with RegisterMapper, by name
+var mappers = make(map[string]*Mapper)
+
+// mapRun records the most recent run of a Mapper
+type mapRun struct {
+	Run     int64     `datastore:",noindex"`
+	Shards  int       `datastore:",noindex"`
+	Started time.Time `datastore:",noindex"`
+}
+
+// mapShard records the progress of one shard of a Mapper run.  Start is
+// inclusive and End is exclusive.  nil means unbounded.
+type mapShard struct {
+	Run     int64          `datastore:",noindex"`
+	Start   *datastore.Key `datastore:",noindex"`
+	End     *datastore.Key `datastore:",noindex"`
+	Cursor  string         `datastore:",noindex"`
+	Slice   int            `datastore:",noindex"`
+	Count   int            `datastore:",noindex"`
+	Done    bool           `datastore:",noindex"`
+	Updated time.Time      `datastore:",noindex"`
+}
+
+// mapTask processes one shard of a Mapper run.  The delay package provides
+// the task handler.  It's assigned in init since runShard enqueues it too.
+var mapTask *delay.Function
+
+func init() {
+	mapTask = delay.Func("aeds.map", func(c context.Context, name string, run int64, shard int) error {
+		m, ok := mappers[name]
+		if !ok {
+			return fmt.Errorf("aeds: no mapper registered as %q", name)
+		}
+		return m.runShard(c, run, shard)
+	})
+}
+
+// RegisterMapper makes a Mapper available to its tasks.  Call it during init.
+// It panics if another Mapper has the same name or if its Proto doesn't
+// implement CanSetStringId.
+func RegisterMapper(m *Mapper) {
+	if _, ok := m.Proto.(CanSetStringId); !ok {
+		panic(fmt.Sprintf("aeds: mapper %q: %T does not implement CanSetStringId", m.Name, m.Proto))
+	}
+	if _, ok := mappers[m.Name]; ok {
+		panic(fmt.Sprintf("aeds: mapper %q registered twice", m.Name))
+	}
+	mappers[m.Name] = m
+}
+
+// Start splits the mapper's kind into shards and enqueues a task for each.
+// It returns once the tasks are enqueued.  Use Progress to follow them.
+//
+// Starting a mapper which is already running abandons the old run.  Its
+// tasks notice and stop after their current batch.  An abandoned shard
+// never overwrites the progress of a newer run.
+func (m *Mapper) Start(c context.Context) error {
+	if IsReadOnly() {
+		return ErrReadOnly
+	}
+	if mappers[m.Name] != m {
+		return fmt.Errorf("aeds: mapper %q isn't registered", m.Name)
+	}
+
+	points, err := m.splitPoints(c)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	run := mapRun{Run: now.UnixNano(), Shards: len(points) + 1, Started: now}
+
+	// record each shard's range
+	keys := make([]*datastore.Key, run.Shards)
+	shards := make([]*mapShard, run.Shards)
+	for i := range shards {
+		keys[i] = m.shardKey(c, i)
+		shards[i] = &mapShard{Run: run.Run, Updated: now}
+		if i > 0 {
+			shards[i].Start = points[i-1]
+		}
+		if i < len(points) {
+			shards[i].End = points[i]
+		}
+	}
+	_, err = datastore.PutMulti(c, keys, shards)
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(c, m.runKey(c), &run)
+	if err != nil {
+		return err
+	}
+
+	tasks := make([]*taskqueue.Task, run.Shards)
+	for i := range tasks {
+		tasks[i], err = mapTask.Task(m.Name, run.Run, i)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = taskqueue.AddMulti(c, tasks, m.Queue)
+	return err
+}
+
+// Progress returns the number of entities mapped so far by the mapper's most
+// recent run and whether every shard has finished.  A mapper which has never
+// been started has made no progress.
+func (m *Mapper) Progress(c context.Context) (int, bool, error) {
+	var run mapRun
+	err := datastore.Get(c, m.runKey(c), &run)
+	if err == datastore.ErrNoSuchEntity {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	keys := make([]*datastore.Key, run.Shards)
+	for i := range keys {
+		keys[i] = m.shardKey(c, i)
+	}
+	shards := make([]mapShard, run.Shards)
+	err = datastore.GetMulti(c, keys, shards)
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
+		return 0, false, err
+	}
+
+	n := 0
+	done := true
+	for i, s := range shards {
+		if merr != nil && merr[i] != nil && merr[i] != datastore.ErrNoSuchEntity {
+			return 0, false, merr[i]
+		}
+		if s.Run != run.Run {
+			done = false // not recorded yet
+			continue
+		}
+		n += s.Count
+		done = done && s.Done
+	}
+	return n, done, nil
+}
+
+// runShard maps over one shard until it's finished or the task has run for
+// mapSlice.  In the latter case, another task continues where it left off.
+func (m *Mapper) runShard(c context.Context, run int64, shard int) error {
+	key := m.shardKey(c, shard)
+	var s mapShard
+	err := datastore.Get(c, key, &s)
+	if err == datastore.ErrNoSuchEntity {
+		return nil // nothing to do
+	}
+	if err != nil {
+		return err
+	}
+	if s.Run != run || s.Done {
+		return nil // superseded by a later Start, or a duplicate task
+	}
+
+	quittingTime := time.Now().Add(mapSlice)
+	for time.Now().Before(quittingTime) {
+		q := datastore.NewQuery(m.Kind).
+			Order("__key__").
+			Limit(DefaultBatchSize).
+			KeysOnly()
+		if s.Start != nil {
+			q = q.Filter("__key__>=", s.Start)
+		}
+		if s.End != nil {
+			q = q.Filter("__key__<", s.End)
+		}
+		if s.Cursor != "" {
+			cursor, err := datastore.DecodeCursor(s.Cursor)
+			if err != nil {
+				return err
+			}
+			q = q.Start(cursor)
+		}
+
+		var keys []*datastore.Key
+		t := q.Run(c)
+		for {
+			k, err := t.Next(nil)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			keys = append(keys, k)
+		}
+		cursor, err := t.Cursor()
+		if err != nil {
+			return err
+		}
+
+		es, err := loadEntities(c, keys, m.Proto)
+		if err != nil {
+			return err
+		}
+		for _, e := range es {
+			err := m.Map(c, e)
+			if err != nil {
+				return err
+			}
+		}
+
+		// record our progress
+		s.Count += len(es)
+		s.Cursor = cursor.String()
+		s.Done = len(keys) < DefaultBatchSize
+		s.Updated = time.Now()
+		err = saveShard(c, key, &s)
+		if err == errMapSuperseded {
+			return nil
+		}
+		if err != nil || s.Done {
+			return err
+		}
+	}
+
+	// hand off to the next task in this shard's chain
+	s.Slice++
+	err = saveShard(c, key, &s)
+	if err == errMapSuperseded {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t, err := mapTask.Task(m.Name, run, shard)
+	if err != nil {
+		return err
+	}
+	t.Name = fmt.Sprintf("aeds-map-%s-%d-%d-%d", m.Name, run, shard, s.Slice)
+	_, err = taskqueue.Add(c, t, m.Queue)
+	if err == taskqueue.ErrTaskAlreadyAdded {
+		return nil
+	}
+	return err
+}
+
+// errMapSuperseded means a shard's run was replaced by a later Start
+var errMapSuperseded = errors.New("aeds: mapper run superseded")
+
+// saveShard stores a shard's progress, unless a later Start has replaced
+// its run
+func saveShard(c context.Context, key *datastore.Key, s *mapShard) error {
+	return datastore.RunInTransaction(c, func(c context.Context) error {
+		var current mapShard
+		err := datastore.Get(c, key, &current)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if current.Run != s.Run {
+			return errMapSuperseded
+		}
+		_, err = datastore.Put(c, key, s)
+		return err
+	}, nil)
+}
+
+// splitPoints chooses keys which divide the mapper's kind into roughly equal
+// ranges, using the datastore's __scatter__ property.  The result is sorted
+// and has at most Shards-1 keys.
+func (m *Mapper) splitPoints(c context.Context) ([]*datastore.Key, error) {
+	shards := m.Shards
+	if shards <= 0 {
+		shards = defaultMapShards
+	}
+
+	keys, err := datastore.NewQuery(m.Kind).
+		Order("__scatter__").
+		Limit(shards*mapOversample).
+		KeysOnly().
+		GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	sort.Sort(byKey(keys))
+
+	points := make([]*datastore.Key, 0, shards-1)
+	for i := 1; i < shards; i++ {
+		k := keys[i*len(keys)/shards]
+		if len(points) > 0 && points[len(points)-1].Equal(k) {
+			continue // too few samples to split here
+		}
+		points = append(points, k)
+	}
+	return points, nil
+}
+
+// runKey returns the key of the entity recording the mapper's latest run
+func (m *Mapper) runKey(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, mapperKind, m.Name, 0, nil)
+}
+
+// shardKey returns the key of the entity recording one shard's progress
+func (m *Mapper) shardKey(c context.Context, shard int) *datastore.Key {
+	return datastore.NewKey(c, mapperShardKind, "", int64(shard)+1, m.runKey(c))
+}
+
+// byKey sorts keys in datastore order
+type byKey []*datastore.Key
+
+func (ks byKey) Len() int           { return len(ks) }
+func (ks byKey) Swap(i, j int)      { ks[i], ks[j] = ks[j], ks[i] }
+func (ks byKey) Less(i, j int) bool { return keyLess(ks[i], ks[j]) }
+
+// keyLess returns true if a sorts before b in the datastore.  Keys are
+// compared one path element at a time, starting from the root.  Within a
+// kind, integer IDs sort before string IDs.
+func keyLess(a, b *datastore.Key) bool {
+	pa, pb := keyPath(a), keyPath(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, y := pa[i], pb[i]
+		if x.Kind() != y.Kind() {
+			return x.Kind() < y.Kind()
+		}
+		xs, ys := x.StringID() != "", y.StringID() != ""
+		if xs != ys {
+			return ys
+		}
+		if x.StringID() != y.StringID() {
+			return x.StringID() < y.StringID()
+		}
+		if x.IntID() != y.IntID() {
+			return x.IntID() < y.IntID()
+		}
+	}
+	return len(pa) < len(pb)
+}
+
+// keyPath returns a key's ancestors, root first, followed by the key itself
+func keyPath(k *datastore.Key) []*datastore.Key {
+	var path []*datastore.Key
+	for ; k != nil; k = k.Parent() {
+		path = append([]*datastore.Key{k}, path...)
+	}
+	return path
+}
+
+// Note_mapper
+//
+// Datastore gives each entity a hidden, random __scatter__ property.  Sorting
+// by it samples keys evenly from the whole kind, so Start reads a few dozen
+// scatter keys per shard, sorts them by key, and uses evenly spaced ones as
+// the boundaries between shards.  That's the same trick App Engine's
+// mapreduce library uses.
+//
+// Each shard's task walks its range in key order, one batch at a time, and
+// stores a query cursor after every batch.  A task which fails is retried by
+// the task queue and resumes from the last cursor, so at most one batch is
+// mapped twice.  After mapSlice, well inside the task deadline, the task
+// enqueues its successor and exits.  The successor is named after the
+// shard's slice counter, which is incremented first, so a retried handoff
+// can't start two chains for the same shard.
@@ -0,0 +1,389 @@
+package aeds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// ExistsMulti reports which of the given IDs belong to existing entities of
+// proto's kind.  Every ID appears in the result.  For cacheable kinds, memcache
+// is checked first and only the remaining IDs are looked up in the datastore.
+// The datastore lookups happen in as few GetMulti calls as possible.
+func ExistsMulti(c context.Context, proto Entity, ids []string) (map[string]bool, error) {
+	exists := make(map[string]bool, len(ids))
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = datastore.NewKey(c, entityKind(c, proto), id, 0, nil)
+		exists[id] = false
+	}
+
+	// anything in memcache, except a tombstone, certainly exists
+	var lookupIds []string
+	var lookupKeys []*datastore.Key
+	var cached map[string]bool
+	if canBeCached(proto) {
+		cacheKeys := make([]string, len(keys))
+		for i, key := range keys {
+			cacheKeys[i] = entityCacheKey(key, proto)
+		}
+		cached = make(map[string]bool)
+		end := startSpan(c, "cache.GetMulti", proto.Kind())
+		err := batchCall(len(cacheKeys), maxGetBatch, func(lo, hi int) error {
+			items, err := CacheBackend.GetMulti(c, cacheKeys[lo:hi])
+			for k, item := range items {
+				v, err := parseCacheValue(item.Value)
+				cached[k] = err == nil && !v.tombstone
+			}
+			return err
+		})
+		end()
+		_ = err // ignore memcache errors. we'll just ask datastore
+	}
+	for i, key := range keys {
+		if cached[entityCacheKey(key, proto)] {
+			exists[ids[i]] = true
+		} else {
+			lookupIds = append(lookupIds, ids[i])
+			lookupKeys = append(lookupKeys, key)
+		}
+	}
+	if len(lookupKeys) == 0 {
+		return exists, nil
+	}
+
+	// ask datastore about the rest
+	dst := make([]datastore.PropertyList, len(lookupKeys))
+	end := startSpan(c, "datastore.GetMulti", proto.Kind())
+	err := batchCall(len(lookupKeys), maxGetBatch, func(lo, hi int) error {
+		return limited(c, func() error {
+			return datastore.GetMulti(c, lookupKeys[lo:hi], dst[lo:hi])
+		})
+	})
+	end()
+	if err == nil {
+		for _, id := range lookupIds {
+			exists[id] = true
+		}
+		return exists, nil
+	}
+	merr, ok := err.(appengine.MultiError)
+	if !ok {
+		return nil, err
+	}
+	for i, err := range merr {
+		switch {
+		case err == nil:
+			exists[lookupIds[i]] = true
+		case err == datastore.ErrNoSuchEntity:
+		default:
+			return nil, err
+		}
+	}
+	return exists, nil
+}
+
+// GetMulti is like Get for many entities at once, skipping all caches.
+// Lookups are split into as few datastore.GetMulti calls as its limits
+// allow.  As with FromId, field mismatch errors are ignored, so an entity with
+// properties its struct lacks still counts as found.
+//
+// If some entities couldn't be fetched, the error is a *BatchError naming
+// them.  Its MultiError has one element per entity, which is nil for those
+// fetched successfully.  Other errors apply to the whole call.  Use
+// GetMultiMismatches to learn which entities had field mismatches.
+func GetMulti(c context.Context, es []Entity) error {
+	_, err := GetMultiMismatches(c, es)
+	return err
+}
+
+// GetMultiMismatches is like GetMulti but also reports which entities were
+// fetched in spite of a field mismatch.  mismatches has an element per
+// entity holding its field mismatch error, or is nil if there were none.
+// Those entities count as fetched, so err is exactly what GetMulti returns.
+func GetMultiMismatches(c context.Context, es []Entity) (mismatches []error, err error) {
+	keys := make([]*datastore.Key, len(es))
+	for i, e := range es {
+		if x, ok := e.(NeedsIdempotentReset); ok {
+			x.IdempotentReset()
+		}
+		keys[i] = Key(c, e)
+	}
+
+	end := startSpan(c, "datastore.GetMulti", multiKind(es))
+	err = batchCall(len(keys), maxGetBatch, func(lo, hi int) error {
+		return limited(c, func() error {
+			return datastore.GetMulti(c, keys[lo:hi], es[lo:hi])
+		})
+	})
+	end()
+	var merr appengine.MultiError
+	if err != nil {
+		var ok bool
+		merr, ok = err.(appengine.MultiError)
+		if !ok {
+			return nil, err
+		}
+	}
+
+	failed := false
+	for i, e := range es {
+		if merr != nil && merr[i] != nil {
+			if !IsErrFieldMismatch(merr[i]) {
+				failed = true
+				continue
+			}
+			if mismatches == nil {
+				mismatches = make([]error, len(es))
+			}
+			mismatches[i] = merr[i]
+			merr[i] = nil
+		}
+
+		err := afterGet(e)
+		if err != nil {
+			if merr == nil {
+				merr = make(appengine.MultiError, len(es))
+			}
+			merr[i] = err
+			failed = true
+			continue
+		}
+		rememberETag(e)
+	}
+	if failed {
+		return mismatches, &BatchError{MultiError: merr, Entities: es, Keys: keys}
+	}
+	return mismatches, nil
+}
+
+// WarmCache makes sure each of the given entities is in memcache.  Each
+// entity only needs enough data to calculate its key.  Entities which are
+// already cached are left alone.  The rest are fetched from the datastore
+// in batches and cached, exactly as FromId would cache them.  Entities which
+// don't exist, and uncacheable entities, are skipped.
+//
+// Each batch is written to memcache in a single call, honoring every
+// entity's CacheTtl.  Returns the number of entities newly cached.  Since
+// most entities are usually cached already, periodic warming costs little
+// more than one GetMulti per batch.
+func WarmCache(c context.Context, es []Entity) (int, error) {
+	var cacheable []Entity
+	for _, e := range es {
+		if canBeCached(e) {
+			cacheable = append(cacheable, e)
+		}
+	}
+
+	n := 0
+	for start := 0; start < len(cacheable); start += DefaultBatchSize {
+		end := start + DefaultBatchSize
+		if end > len(cacheable) {
+			end = len(cacheable)
+		}
+		warmed, err := warmBatch(c, cacheable[start:end])
+		n += warmed
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// warmBatch does the work of WarmCache for a batch of cacheable entities
+func warmBatch(c context.Context, es []Entity) (int, error) {
+	keys := make([]*datastore.Key, len(es))
+	cacheKeys := make([]string, len(es))
+	for i, e := range es {
+		keys[i] = Key(c, e)
+		cacheKeys[i] = entityCacheKey(keys[i], e)
+	}
+	end := startSpan(c, "cache.GetMulti", multiKind(es))
+	items, err := CacheBackend.GetMulti(c, cacheKeys)
+	end()
+	if err != nil {
+		items = nil // we'll just warm them all
+	}
+
+	var missing []Entity
+	var missingKeys []*datastore.Key
+	for i, e := range es {
+		if _, ok := items[cacheKeys[i]]; !ok {
+			missing = append(missing, e)
+			missingKeys = append(missingKeys, keys[i])
+		}
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+
+	err = GetMulti(c, missing)
+	merr := multiError(err)
+	if err != nil && merr == nil {
+		return 0, err
+	}
+
+	var fill []*memcache.Item
+	var fillKeys []*datastore.Key
+	for i, e := range missing {
+		if merr != nil && merr[i] == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if merr != nil && merr[i] != nil {
+			return 0, merr[i]
+		}
+		item, err := filledItem(c, missingKeys[i], e, e.(CanBeCached).CacheTtl())
+		if err != nil {
+			return 0, err
+		}
+		if item != nil {
+			fill = append(fill, item)
+			fillKeys = append(fillKeys, missingKeys[i])
+		}
+	}
+	if len(fill) == 0 {
+		return 0, nil
+	}
+	return storeWarmed(c, multiKind(es), fill, fillKeys), nil
+}
+
+// storeWarmed writes the items built by warmBatch and returns how many were
+// stored.  Like fillCache, it won't overwrite an item which appeared since
+// the entities were found missing, such as a tombstone, if the backend can
+// tell.  That takes one call with CanAddMulti, one per item with only CanAdd
+// and otherwise one SetMulti.  Memcache errors are merely reported.
+func storeWarmed(c context.Context, kind string, items []*memcache.Item, keys []*datastore.Key) int {
+	end := startSpan(c, "cache.SetMulti", kind)
+	var err error
+	if x, ok := CacheBackend.(CanAddMulti); ok {
+		err = x.AddMulti(c, items)
+	} else if x, ok := CacheBackend.(CanAdd); ok {
+		err = addEach(c, x, items)
+	} else {
+		err = CacheBackend.SetMulti(c, items)
+	}
+	end()
+	if err == nil {
+		return len(items)
+	}
+
+	merr, ok := err.(appengine.MultiError)
+	if !ok {
+		for _, key := range keys {
+			reportCacheError(c, key, CacheErrorSet, err)
+		}
+		return 0
+	}
+	n := 0
+	for i, err := range merr {
+		switch err {
+		case nil:
+			n++
+		case memcache.ErrNotStored:
+			// someone filled it first, or it's a tombstone
+		default:
+			reportCacheError(c, keys[i], CacheErrorSet, err)
+		}
+	}
+	return n
+}
+
+// addEach adds items one at a time, as storeFilled would, and reports their
+// errors like AddMulti
+func addEach(c context.Context, x CanAdd, items []*memcache.Item) error {
+	merr := make(appengine.MultiError, len(items))
+	failed := false
+	for i, item := range items {
+		merr[i] = x.Add(c, item)
+		if merr[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return merr
+	}
+	return nil
+}
+
+// ValidateBatch checks that each entity can be stored by PutMulti, without
+// storing anything.  Each entity goes through HookBeforePut and encryption,
+// then is encoded for the datastore and, if it's cacheable, for memcache.
+// The result has an element for each entity, which is nil if the entity is
+// fine.  Fix or drop the others before calling PutMulti.
+func ValidateBatch(es []Entity) []error {
+	errs := make([]error, len(es))
+	for i, e := range es {
+		errs[i] = validateEntity(e)
+	}
+	return errs
+}
+
+// validateEntity does the work of ValidateBatch for a single entity
+func validateEntity(e Entity) error {
+	err := beforePut(e)
+	if err != nil {
+		return err
+	}
+
+	if x, ok := e.(datastore.PropertyLoadSaver); ok {
+		_, err = x.Save()
+	} else {
+		_, err = datastore.SaveStruct(e)
+	}
+	if err == nil && canBeCached(e) {
+		var w countingWriter
+		err = writeCacheValue(&w, e, time.Time{}, time.Time{}, compressesCache(e))
+	}
+	decryptErr := afterPut(e)
+	if err != nil {
+		return err
+	}
+	return decryptErr
+}
+
+// datastore's limits on the number of entities in one batch call
+const (
+	maxGetBatch = 1000
+	maxPutBatch = 500
+)
+
+// batchCall calls f for consecutive ranges [start, end) covering n elements,
+// with at most size elements per call.  Errors from separate calls are
+// merged into one appengine.MultiError with an element for each of the n
+// elements.  An error which isn't a MultiError applies to its whole range.  If
+// a single call is enough, its error is returned as is.
+func batchCall(n, size int, f func(start, end int) error) error {
+	if n <= size {
+		return f(0, n)
+	}
+
+	var merr appengine.MultiError
+	for start := 0; start < n; start += size {
+		end := start + size
+		if end > n {
+			end = n
+		}
+		err := f(start, end)
+		if err == nil {
+			continue
+		}
+
+		if merr == nil {
+			merr = make(appengine.MultiError, n)
+		}
+		if m, ok := err.(appengine.MultiError); ok {
+			copy(merr[start:end], m)
+		} else {
+			for i := start; i < end; i++ {
+				merr[i] = err
+			}
+		}
+	}
+	if merr == nil {
+		return nil
+	}
+	return merr
+}
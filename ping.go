@@ -0,0 +1,57 @@
+package aeds
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// PingError describes which backends failed a Ping.  A nil field means that
+// backend is healthy.
+type PingError struct {
+	Cache     error
+	Datastore error
+}
+
+func (e *PingError) Error() string {
+	switch {
+	case e.Cache != nil && e.Datastore != nil:
+		return fmt.Sprintf("aeds: cache and datastore unavailable: %s; %s", e.Cache, e.Datastore)
+	case e.Cache != nil:
+		return fmt.Sprintf("aeds: cache unavailable: %s", e.Cache)
+	default:
+		return fmt.Sprintf("aeds: datastore unavailable: %s", e.Datastore)
+	}
+}
+
+// Ping checks that the cache and the datastore are reachable, for use in
+// health checks.  It writes and reads back one tiny cache item, then runs a
+// keys-only datastore query which matches nothing.  Both are cheap enough to
+// run often.  If either fails, the error is a *PingError.
+func Ping(c context.Context) error {
+	var perr PingError
+
+	key := KeyPrefix + "aeds: ping"
+	err := CacheBackend.Set(c, &memcache.Item{
+		Key:        key,
+		Value:      []byte{1},
+		Expiration: time.Minute,
+	})
+	if err == nil {
+		_, err = CacheBackend.Get(c, key)
+	}
+	if err != memcache.ErrCacheMiss { // memcache may evict anything at any time
+		perr.Cache = err
+	}
+
+	_, err = datastore.NewQuery("aeds-ping").KeysOnly().Limit(1).GetAll(c, nil)
+	perr.Datastore = err
+
+	if perr.Cache != nil || perr.Datastore != nil {
+		return &perr
+	}
+	return nil
+}
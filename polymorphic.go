@@ -0,0 +1,83 @@
+package aeds
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Decoder chooses the Go type for an entity of a kind which holds several
+// types, usually by looking at a property which tags each entity's type.  It
+// returns a new, zero Entity of that type, which is then loaded from props.
+// The type must implement CanSetStringId, so that the entity gets the ID from
+// its key.  It shouldn't modify props.
+type Decoder func(props datastore.PropertyList) (Entity, error)
+
+// decoders holds every Decoder registered with RegisterDecoder, by kind
+var decoders = make(map[string]Decoder)
+
+// RegisterDecoder makes a Decoder available to GetAllPolymorphic for
+// entities of the given kind.  Call it during init.  It panics if the kind
+// already has a Decoder.
+func RegisterDecoder(kind string, d Decoder) {
+	if _, ok := decoders[kind]; ok {
+		panic(fmt.Sprintf("aeds: decoder for kind %q registered twice", kind))
+	}
+	decoders[kind] = d
+}
+
+// GetAllPolymorphic runs a query whose results may have different Go types.
+// Each result is given to the Decoder registered for its kind, and the
+// returned Entity is loaded and passed through HookAfterGet like FromId
+// would.  Results come back in query order along with their keys.
+//
+// q must not be a keys-only or projection query.  Like any query, its results
+// are eventually consistent and never come from the cache.
+func GetAllPolymorphic(c context.Context, q *datastore.Query) ([]Entity, []*datastore.Key, error) {
+	var rows []datastore.PropertyList
+	keys, err := QueryConsistency(c, q).GetAll(c, &rows)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	es := make([]Entity, len(keys))
+	for i, key := range keys {
+		es[i], err = decodeProperties(key, rows[i])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return es, keys, nil
+}
+
+// decodeProperties builds an entity from its raw properties using the
+// Decoder for its kind
+func decodeProperties(key *datastore.Key, props datastore.PropertyList) (Entity, error) {
+	d, ok := decoders[key.Kind()]
+	if !ok {
+		return nil, fmt.Errorf("aeds: no decoder registered for kind %q", key.Kind())
+	}
+	e, err := d(props)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := e.(CanSetStringId); !ok {
+		return nil, fmt.Errorf("aeds: %T (kind %q) does not implement CanSetStringId", e, key.Kind())
+	}
+
+	if x, ok := e.(datastore.PropertyLoadSaver); ok {
+		err = x.Load(props)
+	} else {
+		err = datastore.LoadStruct(e, props)
+	}
+	if err != nil && !IsErrFieldMismatch(err) {
+		return nil, err
+	}
+	e.(CanSetStringId).SetStringId(key.StringID())
+	err = afterGet(e)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
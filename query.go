@@ -0,0 +1,150 @@
+package aeds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// DefaultBatchSize is the number of entities fetched per query batch when a
+// caller doesn't specify one.
+const DefaultBatchSize = 500
+
+// AllKeys calls fn with successive batches of keys for every entity of the
+// given kind.  Each batch holds at most batch keys (or DefaultBatchSize if
+// batch isn't positive).  Entity bodies are never loaded.  If fn returns an
+// error, AllKeys stops and returns it.
+//
+// To run inside a time budget, give c a deadline with context.WithTimeout.
+// AllKeys checks the context before each batch and returns the context's error
+// once it's done.
+func AllKeys(c context.Context, kind string, batch int, fn func([]*datastore.Key) error) error {
+	if batch <= 0 {
+		batch = DefaultBatchSize
+	}
+
+	q := datastore.NewQuery(kind).KeysOnly().Limit(batch)
+	q = QueryConsistency(c, q)
+	for {
+		err := c.Err()
+		if err != nil {
+			return err
+		}
+
+		keys := make([]*datastore.Key, 0, batch)
+		t := q.Run(c)
+		for {
+			key, err := t.Next(nil)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+
+		cursor, err := t.Cursor()
+		if err != nil {
+			return err
+		}
+		err = fn(keys)
+		if err != nil {
+			return err
+		}
+		if len(keys) < batch {
+			return nil // that was the last batch
+		}
+		q = q.Start(cursor)
+	}
+}
+
+// DeleteAllOfKind deletes every entity of the given kind, along with any
+// cached copies, and returns how many were deleted.  It's meant for tests and
+// administrative cleanup, so there's no time budget beyond the context's own
+// deadline.  If it fails partway, the count reflects what was deleted before
+// the failure.
+//
+// Only the kind is known, so cached copies are cleared after the entities are
+// deleted, rather than replaced by tombstones first, and copies under a
+// schema version (See HasSchemaVersion) are left to expire.  Heavy fields
+// (See HasHeavyField) aren't removed either.  Use DeleteAllOf for those.
+func DeleteAllOfKind(c context.Context, kind string) (int, error) {
+	return deleteAll(c, kind, nil)
+}
+
+// DeleteAllOf is like DeleteAllOfKind for the kind of proto, which supplies
+// the entities' Go type.  Knowing the type, it replaces cached copies with
+// tombstones, like Delete, under proto's schema version and removes heavy
+// fields.  Uncacheable kinds skip the cache.
+func DeleteAllOf(c context.Context, proto Entity) (int, error) {
+	return deleteAll(c, entityKind(c, proto), proto)
+}
+
+// deleteAll does the work of DeleteAllOfKind and DeleteAllOf.  proto is nil
+// if only the kind is known.
+func deleteAll(c context.Context, kind string, proto Entity) (int, error) {
+	if IsReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	n := 0
+	err := AllKeys(c, kind, DefaultBatchSize, func(keys []*datastore.Key) error {
+		if proto != nil && canBeCached(proto) {
+			err := writeTombstones(c, keys, proto)
+			if err != nil {
+				return err
+			}
+		}
+
+		doomed := keys
+		if _, ok := proto.(HasHeavyField); ok {
+			doomed = make([]*datastore.Key, 0, 2*len(keys))
+			for _, key := range keys {
+				doomed = append(doomed, key, heavyKey(c, key))
+			}
+		}
+		err := batchCall(len(doomed), maxPutBatch, func(lo, hi int) error {
+			return limited(c, func() error {
+				return datastore.DeleteMulti(c, doomed[lo:hi])
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		// the kind may not be cacheable, but we can't tell from here
+		if proto == nil {
+			cacheKeys := make([]string, len(keys))
+			for i, key := range keys {
+				cacheKeys[i] = cacheKey(key)
+			}
+			err = deleteCacheKeys(c, cacheKeys)
+			if err != nil {
+				return err
+			}
+		}
+		n += len(keys)
+		for _, key := range keys {
+			reportMutation(c, key, MutationDelete)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// writeTombstones is like writeTombstone for the entities of proto's type
+// with the given keys
+func writeTombstones(c context.Context, keys []*datastore.Key, proto Entity) error {
+	items := make([]*memcache.Item, len(keys))
+	for i, key := range keys {
+		items[i] = &memcache.Item{Key: entityCacheKey(key, proto), Value: tombstoneValue, Expiration: tombstoneTtl}
+	}
+	end := startSpan(c, "cache.SetMulti", keys[0].Kind())
+	err := CacheBackend.SetMulti(c, items)
+	end()
+	return err
+}
@@ -0,0 +1,22 @@
+package aeds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// FetchRaw reads an entity of any kind as a property list, for tools like an
+// admin browser which don't know the entity's Go type.  It always reads the
+// datastore, never the cache, and no hooks run.  Fields encrypted by
+// HasEncryption appear as ciphertext.  Returns datastore.ErrNoSuchEntity if
+// the entity doesn't exist.
+func FetchRaw(c context.Context, key *datastore.Key) (datastore.PropertyList, error) {
+	var props datastore.PropertyList
+	end := startSpan(c, "datastore.Get", key.Kind())
+	err := limited(c, func() error { return datastore.Get(c, key, &props) })
+	end()
+	if err != nil {
+		return nil, err
+	}
+	return props, nil
+}
@@ -0,0 +1,31 @@
+package aeds
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrReadOnly is returned by operations which would write to the datastore
+// while read-only mode is enabled.
+var ErrReadOnly = errors.New("aeds: datastore is in read-only mode")
+
+var readOnly int32
+
+// SetReadOnly enables or disables read-only mode for this instance.  While
+// it's enabled, operations which write to the datastore (in this package and
+// in kvs) fail immediately with ErrReadOnly rather than issuing doomed RPCs.
+// Reads continue to work, including reads from memcache.
+//
+// This is meant for planned datastore maintenance and for incidents.
+func SetReadOnly(enabled bool) {
+	var n int32
+	if enabled {
+		n = 1
+	}
+	atomic.StoreInt32(&readOnly, n)
+}
+
+// IsReadOnly returns true if read-only mode is enabled.
+func IsReadOnly() bool {
+	return atomic.LoadInt32(&readOnly) == 1
+}
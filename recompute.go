@@ -0,0 +1,92 @@
+package aeds
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// recomputeCheckpoint records how far RecomputeAll has progressed through a
+// kind
+type recomputeCheckpoint struct {
+	Kind    string         `datastore:",noindex"`
+	Last    *datastore.Key `datastore:",noindex"`
+	Updated time.Time      `datastore:",noindex"`
+}
+
+// RecomputeAll rewrites every entity of the given kind so that fields derived
+// by HookBeforePut are stored with their current definition.  Each entity is
+// loaded into a new instance of proto's type (running HookAfterGet), which
+// must implement CanSetStringId, and then stored with PutMulti (running
+// HookBeforePut and clearing caches).  Returns the number of entities
+// rewritten by this call.
+//
+// Entities are processed in key order, one batch at a time, and progress is
+// recorded in the kind "recomputes".  To limit how long it runs, give c a
+// deadline with context.WithTimeout.  When the deadline passes, RecomputeAll
+// returns the context's error.  Calling it again resumes after the last
+// completed batch.  Once the whole kind is done, the progress is removed, so
+// the next call starts over.
+//
+// Rewriting an entity counts as updating it, so Timestamps.UpdatedAt changes.
+func RecomputeAll(c context.Context, kind string, proto Entity) (int, error) {
+	if IsReadOnly() {
+		return 0, ErrReadOnly
+	}
+	if _, ok := proto.(CanSetStringId); !ok {
+		return 0, fmt.Errorf("aeds: kind %q does not implement CanSetStringId", kind)
+	}
+
+	// where did we leave off?
+	cpKey := datastore.NewKey(c, "recomputes", kind, 0, nil)
+	cp := recomputeCheckpoint{Kind: kind}
+	err := datastore.Get(c, cpKey, &cp)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return 0, err
+	}
+
+	n := 0
+	for {
+		err := c.Err()
+		if err != nil {
+			return n, err
+		}
+
+		q := datastore.NewQuery(kind).
+			Order("__key__").
+			Limit(DefaultBatchSize).
+			KeysOnly()
+		if cp.Last != nil {
+			q = q.Filter("__key__>", cp.Last)
+		}
+		keys, err := q.GetAll(c, nil)
+		if err != nil {
+			return n, err
+		}
+		if len(keys) == 0 {
+			return n, datastore.Delete(c, cpKey) // all done
+		}
+
+		es, err := loadEntities(c, keys, proto)
+		if err != nil {
+			return n, err
+		}
+		if len(es) > 0 {
+			_, err = PutMulti(c, es)
+			if err != nil {
+				return n, err
+			}
+		}
+		n += len(es)
+
+		// record our progress
+		cp.Last = keys[len(keys)-1]
+		cp.Updated = time.Now()
+		_, err = datastore.Put(c, cpKey, &cp)
+		if err != nil {
+			return n, err
+		}
+	}
+}
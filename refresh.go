@@ -0,0 +1,115 @@
+package aeds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// CanRefreshInBackground is implemented by any Entity implementing CanBeStale
+// which prefers a prompt stale value to a slow fresh one.  When FromId finds a
+// cached value which has outlived CacheTtl but not StaleTtl, it returns the
+// cached value immediately and refreshes memcache from the datastore in a task
+// queue task.  See Note_refresh
+//
+// The entity is sent to the task with gob, so its concrete type must be
+// registered with gob.Register.
+type CanRefreshInBackground interface {
+	// RefreshInBackground returns true if stale cached values should be
+	// served while they're refreshed.
+	RefreshInBackground() bool
+}
+
+// refreshGrace is how long a claimed stale value keeps being served while
+// its refresh task runs
+const refreshGrace = 30 * time.Second
+
+// refreshTask reloads an entity from the datastore into memcache.  The delay
+// package provides the task handler.
+var refreshTask = delay.Func("aeds.refresh", func(c context.Context, e Entity) error {
+	x, ok := e.(CanBeCached)
+	if !ok || x.CacheTtl() <= 0 {
+		return nil
+	}
+
+	// the claimed item guards against replacing a tombstone
+	key := Key(c, e)
+	prev, err := CacheBackend.Get(c, entityCacheKey(key, e))
+	if err != nil {
+		prev = nil
+	}
+	if prev != nil {
+		v, err := parseCacheValue(prev.Value)
+		if err == nil && v.tombstone {
+			return nil // deleted since the refresh was claimed
+		}
+	}
+	err = Get(c, e)
+	if err == datastore.ErrNoSuchEntity {
+		return nil // Delete already took care of the cache
+	}
+	if err != nil {
+		return err
+	}
+	return fillCache(c, key, e, x.CacheTtl(), prev)
+})
+
+// refreshesInBackground returns true if e wants stale values refreshed in the
+// background
+func refreshesInBackground(e Entity) bool {
+	x, ok := e.(CanRefreshInBackground)
+	return ok && x.RefreshInBackground()
+}
+
+// refreshLater arranges for a stale cached value to be refreshed in the
+// background.  item is the memcache item holding the value and e has only
+// enough data to calculate its key.  Returns true if the stale value should
+// be served meanwhile.  If false, the caller should read the datastore itself.
+func refreshLater(c context.Context, e Entity, item *memcache.Item) bool {
+	if kindOverridden(c, e) {
+		return false // the task would refresh e.Kind() instead
+	}
+
+	// claim the refresh by making the value fresh for a little while.  other
+	// requests see the fresh value instead of enqueueing duplicate tasks.
+	// the item from Get is reused since it carries memcache's CAS ID
+	item.Value = append([]byte(nil), item.Value...)
+	item.Expiration = refreshGrace
+	setFreshUntil(item.Value, time.Now().Add(refreshGrace))
+	setExpiresAt(item.Value, time.Now().Add(refreshGrace))
+	var err error
+	if x, ok := CacheBackend.(CanCompareAndSwap); ok {
+		err = x.CompareAndSwap(c, item)
+	} else {
+		err = CacheBackend.Set(c, item)
+	}
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+		return true // another request is already refreshing it
+	}
+	if err != nil {
+		return false
+	}
+
+	err = refreshTask.Call(c, e)
+	if err != nil {
+		log.Warningf(c, "aeds: can't enqueue refresh of %s: %s", Key(c, e), err)
+		return false
+	}
+	return true
+}
+
+// Note_refresh
+//
+// Without background refresh, the first request to read an entity after its
+// cached value expires pays for a datastore read.  For hot entities, several
+// requests might do so at once.  With background refresh, the value lives on
+// in memcache for StaleTtl longer.  The first request to find it stale
+// rewrites it with a short freshness deadline (refreshGrace) and expiration,
+// then enqueues a task to reload it.  Using compare-and-swap, only one request
+// wins that race.  Everyone keeps getting the old value until the task
+// replaces it.  If the task fails, the value expires after refreshGrace and
+// reads go to the datastore as usual.
@@ -0,0 +1,82 @@
+package aeds
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strings"
+)
+
+// Register records concrete types which may appear in an entity's interface
+// fields.  Cached entities are encoded with gob, which can only encode an
+// interface value if its concrete type has been registered.  Call Register
+// during initialization with a value of every such type.
+//
+// Register panics, naming the offending type, if gob rejects a registration.
+// That usually means two different types were registered under the same name.
+func Register(values ...interface{}) {
+	for _, v := range values {
+		register(v)
+	}
+}
+
+func register(v interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			panic(fmt.Sprintf("aeds: can't register %T: %v", v, r))
+		}
+	}()
+	gob.Register(v)
+}
+
+// RegisterEntity checks at initialization that a cacheable entity type can
+// make the round trip through gob, which FromId relies on.  proto is encoded
+// and decoded into a new value of the same type.  A zero value checks the
+// struct's fields, but an example with interface and pointer fields populated
+// is more thorough.  Uncacheable entities aren't checked.
+//
+// RegisterEntity panics with a descriptive message if the check fails, so a
+// problem surfaces at startup instead of on the first cache miss in
+// production.
+func RegisterEntity(proto Entity) {
+	if !canBeCached(proto) {
+		return
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(proto)
+	if err == nil {
+		err = gob.NewDecoder(&buf).Decode(newEntity(proto))
+	}
+	if err != nil {
+		panic(fmt.Sprintf("aeds: entity %T (kind %q) can't be cached: %s", proto, proto.Kind(), gobError(proto, err)))
+	}
+}
+
+// gobError makes a gob encoding error for entity e more descriptive
+func gobError(e Entity, err error) error {
+	if err == nil || !strings.Contains(err.Error(), "not registered") {
+		return err
+	}
+	return fmt.Errorf("aeds: can't encode %T for memcache. call aeds.Register with the concrete types of its interface fields: %s", e, err)
+}
+
+// WarmGob primes gob's type information for each entity type, which gob
+// otherwise builds during the first encode of each type.  Call it during
+// initialization so that the first Put or cache fill of each type after an
+// instance starts isn't slower than the rest.  A zero value of each type
+// makes the round trip.  Uncacheable entities are skipped and failures are
+// ignored.  Use RegisterEntity to catch those.
+func WarmGob(protos ...Entity) {
+	for _, proto := range protos {
+		if !canBeCached(proto) {
+			continue
+		}
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(newEntity(proto))
+		if err == nil {
+			err = gob.NewDecoder(&buf).Decode(newEntity(proto))
+		}
+		_ = err // warming is an optimization. ignore errors
+	}
+}
@@ -0,0 +1,45 @@
+//go:build go1.18
+// +build go1.18
+
+package aeds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Repo provides type-safe access to entities of a single type.  T is the
+// entity's struct type and PT is its pointer type, which must implement
+// Entity and CanSetStringId.  For example,
+//
+//	var Users aeds.Repo[User, *User]
+//	u, err := Users.Get(c, "alice")
+//
+// Each method is built on the corresponding package function, so hooks and
+// caching behave identically.
+type Repo[T any, PT interface {
+	*T
+	Entity
+	CanSetStringId
+}] struct{}
+
+// Get fetches the entity with the given ID, like FromId.
+func (Repo[T, PT]) Get(c context.Context, id string) (*T, error) {
+	e := PT(new(T))
+	e.SetStringId(id)
+	_, err := FromId(c, e)
+	if err != nil {
+		return nil, err
+	}
+	return (*T)(e), nil
+}
+
+// Put stores an entity, like Put.
+func (Repo[T, PT]) Put(c context.Context, e *T) (*datastore.Key, error) {
+	return Put(c, PT(e))
+}
+
+// Delete removes an entity, like Delete.
+func (Repo[T, PT]) Delete(c context.Context, e *T) error {
+	return Delete(c, PT(e))
+}
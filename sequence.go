@@ -44,6 +44,10 @@ func (self Sequence) key(c context.Context) *datastore.Key {
 // value in datastore.  This method should only be called from inside a
 // datastore transaction.
 func (self Sequence) Next(c context.Context) int64 {
+	if IsReadOnly() {
+		panic(ErrReadOnly)
+	}
+
 	n, ok := self.MaybeCurrent(c)
 	if ok {
 		n = n + self.Increment
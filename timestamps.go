@@ -0,0 +1,60 @@
+package aeds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// HasTimestamps is implemented by any Entity that records when it was
+// written.  Put, PutMulti, PutGetOld, PutTx and Modify call SetTimestamps with
+// the current time just before HookBeforePut.  Embedding Timestamps is the
+// easiest way to implement it.
+type HasTimestamps interface {
+	SetTimestamps(now time.Time)
+}
+
+// Timestamps can be embedded in an entity struct to record when the entity
+// was created and last updated.  UpdatedAt is indexed so that ChangedSince
+// can find recently changed entities.
+type Timestamps struct {
+	CreatedAt time.Time `datastore:",noindex"`
+	UpdatedAt time.Time
+}
+
+// SetTimestamps implements HasTimestamps.
+func (t *Timestamps) SetTimestamps(now time.Time) {
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = now
+	}
+	t.UpdatedAt = now
+}
+
+// stamp records details about a write on e, just before it happens
+func stamp(c context.Context, e Entity) {
+	stampActor(c, e)
+	if x, ok := e.(HasTimestamps); ok {
+		x.SetTimestamps(time.Now())
+	}
+}
+
+// ChangedSince returns the keys of entities of the given kind whose UpdatedAt
+// (see Timestamps) is after t, in order of UpdatedAt.  At most limit keys are
+// returned, if limit is positive.
+//
+// It's meant for incremental syncing: remember the UpdatedAt of the last
+// entity processed and pass it as t next time.  Since queries are eventually
+// consistent, a recent change might not appear right away.  Going back a few
+// seconds further than strictly necessary, and tolerating entities seen
+// twice, keeps a sync from missing changes.
+func ChangedSince(c context.Context, kind string, t time.Time, limit int) ([]*datastore.Key, error) {
+	q := datastore.NewQuery(kind).
+		Filter("UpdatedAt>", t).
+		Order("UpdatedAt").
+		KeysOnly()
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	return QueryConsistency(c, q).GetAll(c, nil)
+}
@@ -0,0 +1,52 @@
+package aeds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+// TouchCache extends the lifetime of an entity's cached value without reading
+// from the datastore.  The value is stored again with a fresh expiration of
+// CacheTtl (plus StaleTtl, if any), so entities which are accessed often stay
+// in memcache.  Only enough of e to calculate its key is needed.
+//
+// If the entity isn't cached, or its cached value is already stale,
+// TouchCache does nothing.  If the backend implements CanCompareAndSwap, a
+// value which changes or disappears while being touched is left alone.
+func TouchCache(c context.Context, e Entity) error {
+	if !canBeCached(e) {
+		return nil
+	}
+	ttl := e.(CanBeCached).CacheTtl()
+
+	key := entityCacheKey(Key(c, e), e)
+	item, err := CacheBackend.Get(c, key)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	v, err := parseCacheValue(item.Value)
+	if err != nil || v.tombstone || !v.fits(e) || v.isStale() {
+		return nil // FromId will replace the value anyway
+	}
+
+	expiration, freshUntil := cacheTimes(e, ttl)
+	if !v.freshUntil.IsZero() && !freshUntil.IsZero() {
+		setFreshUntil(item.Value, freshUntil)
+	}
+	setExpiresAt(item.Value, time.Now().Add(expiration))
+	item.Expiration = expiration
+
+	if x, ok := CacheBackend.(CanCompareAndSwap); ok {
+		err = x.CompareAndSwap(c, item)
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			return nil // someone else changed it first
+		}
+		return err
+	}
+	return CacheBackend.Set(c, item)
+}
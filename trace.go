@@ -0,0 +1,39 @@
+package aeds
+
+import (
+	"golang.org/x/net/context"
+)
+
+// Tracer is implemented by tracing systems which want to record how long aeds
+// spends in each datastore and cache call.  An adapter for Cloud Trace, for
+// example, might start a span labeled with op and kind.  Keeping the tracer
+// behind this interface means aeds doesn't depend on any tracing library.
+type Tracer interface {
+	// StartSpan begins timing an operation and returns a function which ends
+	// it.  op is the call being made, such as "datastore.Get" or "cache.Set".
+	// kind is the kind of the entities involved.
+	StartSpan(c context.Context, op, kind string) func()
+}
+
+// Tracing, if not nil, receives a span for every datastore and cache call
+// made by Get, GetMulti, Put, PutMulti, Delete, FromId, ExistsMulti and
+// Modify.  Set it during initialization.
+var Tracing Tracer
+
+// startSpan starts a span if tracing is enabled.  The result must be called
+// to end the span.
+func startSpan(c context.Context, op, kind string) func() {
+	if Tracing == nil {
+		return func() {}
+	}
+	return Tracing.StartSpan(c, op, kind)
+}
+
+// multiKind returns the kind of a batch of entities, assuming they all share
+// one
+func multiKind(es []Entity) string {
+	if len(es) == 0 {
+		return ""
+	}
+	return es[0].Kind()
+}
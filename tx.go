@@ -0,0 +1,171 @@
+package aeds
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var errNoTransaction = errors.New("aeds: transactional call outside of aeds.RunInTransaction")
+
+// txKey is the context key for a transaction's changes
+type txKey struct{}
+
+// txChanges records the entities written or deleted during one attempt at a
+// transaction
+type txChanges struct {
+	puts    []Entity
+	deletes []Entity
+}
+
+// RunInTransaction runs f in a datastore transaction, like
+// datastore.RunInTransaction.  Within f, use PutTx, DeleteTx and FromIdTx
+// with the transactional context tc.  Once the transaction commits, aeds
+// clears the cache entries of every entity written or deleted, so caches stay
+// consistent even though several entities changed at once.
+//
+// As with datastore.RunInTransaction, f may be called several times, so it
+// should be idempotent.  Changes from failed attempts are forgotten.
+func RunInTransaction(c context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error {
+	if IsReadOnly() {
+		return ErrReadOnly
+	}
+
+	var changes *txChanges
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		changes = &txChanges{}
+		return f(context.WithValue(tc, txKey{}, changes))
+	}, opts)
+	if err != nil {
+		return err
+	}
+
+	// See Note_1
+	var cacheErr error
+	for _, e := range changes.puts {
+		rememberETag(e)
+		err := afterCommit(c, e, MutationPut)
+		if cacheErr == nil {
+			cacheErr = err
+		}
+	}
+	for _, e := range changes.deletes {
+		err := afterCommit(c, e, MutationDelete)
+		if cacheErr == nil {
+			cacheErr = err
+		}
+	}
+	return cacheErr
+}
+
+// afterCommit does the work that follows a committed change to e.  It
+// returns an error only if MemcacheErrorPolicy says a cache failure should be
+// returned.
+func afterCommit(c context.Context, e Entity, op string) error {
+	key := Key(c, e)
+	var err error
+	if op == MutationDelete {
+		err = writeTombstone(c, e) // See Note_tombstone
+	} else {
+		err = ClearCache(c, e)
+	}
+	if err != nil {
+		err = clearCacheFailed(c, "RunInTransaction", key, err)
+	}
+	reportMutation(c, key, op)
+	invalidateDependencies(c, e)
+	return err
+}
+
+// txChangesFrom returns the changes being recorded by RunInTransaction
+func txChangesFrom(tc context.Context) (*txChanges, error) {
+	changes, ok := tc.Value(txKey{}).(*txChanges)
+	if !ok {
+		return nil, errNoTransaction
+	}
+	return changes, nil
+}
+
+// PutTx stores an entity within a transaction started by RunInTransaction.
+// Its cache entry is cleared after the transaction commits.
+func PutTx(tc context.Context, e Entity) (*datastore.Key, error) {
+	changes, err := txChangesFrom(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	lookupKey := Key(tc, e)
+	stamp(tc, e)
+	if x, ok := e.(HasChangeHook); ok {
+		old, err := readOld(tc, lookupKey, e)
+		if err != nil {
+			return nil, err
+		}
+		x.HookBeforePutWithOld(old)
+	}
+	err = putHeavy(tc, []Entity{e})
+	if err != nil {
+		return nil, err
+	}
+	err = beforePut(e)
+	if err != nil {
+		return nil, err
+	}
+	var key *datastore.Key
+	err = limited(tc, func() error {
+		var err error
+		key, err = datastore.Put(tc, lookupKey, e)
+		return err
+	})
+	decryptErr := afterPut(e)
+	if err != nil {
+		return nil, err
+	}
+	if decryptErr != nil {
+		return nil, decryptErr
+	}
+
+	changes.puts = append(changes.puts, e)
+	return key, nil
+}
+
+// DeleteTx removes an entity within a transaction started by
+// RunInTransaction.  Its cache entry is cleared after the transaction
+// commits.
+func DeleteTx(tc context.Context, e Entity) error {
+	changes, err := txChangesFrom(tc)
+	if err != nil {
+		return err
+	}
+
+	key := Key(tc, e)
+	err = limited(tc, func() error {
+		if _, ok := e.(HasHeavyField); ok {
+			return datastore.DeleteMulti(tc, []*datastore.Key{key, heavyKey(tc, key)})
+		}
+		return datastore.Delete(tc, key)
+	})
+	if err != nil {
+		return err
+	}
+
+	changes.deletes = append(changes.deletes, e)
+	return nil
+}
+
+// FromIdTx fetches an entity within a transaction started by
+// RunInTransaction.  It always reads from the datastore, since a cached value
+// could be older than the transaction's snapshot.
+func FromIdTx(tc context.Context, e Entity) (Entity, error) {
+	_, err := txChangesFrom(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = Get(tc, e)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,73 @@
+package aeds
+
+import (
+	"fmt"
+	"math/rand"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// VerifyReport summarizes a run of VerifyCache
+type VerifyReport struct {
+	Sampled    int // entities compared
+	Cached     int // sampled entities with a value in the cache
+	Mismatches []VerifyMismatch
+}
+
+// VerifyMismatch describes an entity whose cached value disagrees with the
+// datastore
+type VerifyMismatch struct {
+	Key    *datastore.Key
+	Reason string // See InspectResult.Reason
+}
+
+// VerifyCache audits the cache for a kind.  It visits each entity of the kind
+// with probability sample (between 0 and 1) and compares its cached value
+// with the datastore using Inspect.  Entities which simply aren't cached are
+// fine.  Every other disagreement is reported as a mismatch, which usually
+// points to a write that didn't invalidate the cache.
+//
+// proto supplies the entities' type and must implement CanSetStringId.  A
+// mismatch is inspected a second time before it's reported, so writes which
+// happen during the audit aren't mistaken for stale values.  To run inside a
+// time budget, give c a deadline.  The report covers the entities visited
+// before it ran out.
+func VerifyCache(c context.Context, kind string, proto Entity, sample float64) (VerifyReport, error) {
+	var report VerifyReport
+	if _, ok := proto.(CanSetStringId); !ok {
+		return report, fmt.Errorf("aeds: kind %q does not implement CanSetStringId", kind)
+	}
+
+	err := AllKeys(c, kind, DefaultBatchSize, func(keys []*datastore.Key) error {
+		for _, key := range keys {
+			if rand.Float64() >= sample {
+				continue
+			}
+			e := newEntity(proto)
+			e.(CanSetStringId).SetStringId(key.StringID())
+
+			r, err := Inspect(c, e)
+			if err != nil {
+				return err
+			}
+			report.Sampled++
+			if r.CachedValue != nil {
+				report.Cached++
+			}
+			if r.Match || r.CachedValue == nil {
+				continue
+			}
+
+			r, err = Inspect(c, e) // maybe it was changing
+			if err != nil {
+				return err
+			}
+			if !r.Match && r.CachedValue != nil {
+				report.Mismatches = append(report.Mismatches, VerifyMismatch{Key: key, Reason: r.Reason})
+			}
+		}
+		return nil
+	})
+	return report, err
+}